@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// daemonMode is set when the app keeps running between scheduled runs
+	daemonMode bool
+
+	// paused holds back scheduled runs, and the channels left in a run in progress
+	paused atomic.Bool
+
+	// runRequests starts a daemon run ahead of schedule. One request is kept while a run is in progress.
+	runRequests = make(chan struct{}, 1)
+)
+
+// waitWhilePaused blocks until the daemon is resumed
+func waitWhilePaused() {
+	if paused.Load() {
+		log.Infof("Paused, waiting to be resumed")
+	}
+	for paused.Load() {
+		time.Sleep(time.Second)
+	}
+}
+
+// adminToken reads the bearer token of the admin API from ADMIN_TOKEN or the file named by ADMIN_TOKEN_FILE
+func adminToken() string {
+	token := os.Getenv("ADMIN_TOKEN")
+	if tokenFile := os.Getenv("ADMIN_TOKEN_FILE"); tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			log.Fatalf("Error reading ADMIN_TOKEN_FILE: %v", err)
+		}
+		token = string(data)
+	}
+	return strings.TrimSpace(token)
+}
+
+// registerAdminAPI serves the admin API under /admin/ when an admin token is configured
+func registerAdminAPI(mux *http.ServeMux, dg *discordgo.Session) {
+	token := adminToken()
+	if token == "" {
+		log.Info("Admin API disabled, set ADMIN_TOKEN to enable it")
+		return
+	}
+
+	auth := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+			handler(w, r)
+		}
+	}
+
+	mux.HandleFunc("GET /admin/status", auth(adminStatus))
+	mux.HandleFunc("POST /admin/scan", auth(adminScan(dg)))
+	mux.HandleFunc("POST /admin/pause", auth(adminPause(true)))
+	mux.HandleFunc("POST /admin/resume", auth(adminPause(false)))
+	mux.HandleFunc("GET /admin/queue", auth(adminQueue))
+	mux.HandleFunc("GET /admin/deadletters", auth(adminDeadLetters))
+	log.Info("Admin API enabled")
+}
+
+// adminStatus reports whether the daemon is paused and the latest run over every guild
+func adminStatus(w http.ResponseWriter, r *http.Request) {
+	activeTargets.Lock()
+	targets := activeTargets.targets
+	activeTargets.Unlock()
+
+	guilds := map[string]any{}
+	for _, target := range targets {
+		if status, ok := guildRunStatus(target.GuildID); ok {
+			guilds[target.GuildID] = status
+		} else {
+			guilds[target.GuildID] = nil
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"daemon": daemonMode, "paused": paused.Load(), "guilds": guilds})
+}
+
+// adminScan starts a run ahead of schedule, or scans one channel when the body names one:
+// {"channel_id": "..."}
+func adminScan(dg *discordgo.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ChannelID string `json:"channel_id"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+				return
+			}
+		}
+
+		if request.ChannelID == "" {
+			if !daemonMode {
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "runs can only be started ahead of schedule in daemon mode"})
+				return
+			}
+			select {
+			case runRequests <- struct{}{}:
+				log.Infof("Run requested through the admin API")
+			default:
+			}
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "run queued"})
+			return
+		}
+
+		channel, err := dg.Channel(request.ChannelID)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "channel couldn't be fetched: " + err.Error()})
+			return
+		}
+		target := activeTarget(channel.GuildID)
+		if target == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "the channel's guild isn't archived"})
+			return
+		}
+
+		log.Infof("Scan of channel %s requested through the admin API", channel.ID)
+		queueChannelScan(dg, target, channel, func() {
+			log.Infof("Finished the requested scan of channel %s", channel.ID)
+		})
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "scan queued", "channel_id": channel.ID})
+	}
+}
+
+// adminPause pauses or resumes the daemon
+func adminPause(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if paused.Swap(pause) != pause {
+			if pause {
+				log.Infof("Paused through the admin API")
+			} else {
+				log.Infof("Resumed through the admin API")
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"paused": pause})
+	}
+}
+
+// adminQueue lists the transfers in progress and the failed attachments waiting to be retried
+func adminQueue(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"in_flight": inFlightTransfers(),
+		"pending":   adminFailedJobs(false),
+	})
+}
+
+// adminDeadLetters lists the attachments that used up their retry attempts
+func adminDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"dead_letters": adminFailedJobs(true)})
+}
+
+// adminFailedJobs collects the failed jobs of every archived guild, either dead letters or those still being retried
+func adminFailedJobs(dead bool) []*FailedJob {
+	activeTargets.Lock()
+	targets := activeTargets.targets
+	activeTargets.Unlock()
+
+	jobs := []*FailedJob{}
+	for _, target := range targets {
+		jobs = append(jobs, target.Retries.list(target.GuildID, dead)...)
+	}
+	return jobs
+}
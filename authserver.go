@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// authServer receives OAuth redirects for every provider waiting on a browser authorization.
+// It listens on HTTP_PORT only while at least one flow is pending, and routes each callback by its state parameter.
+type authServer struct {
+	mu       sync.Mutex
+	server   *http.Server
+	stopping chan struct{} // closed once a shutting down server has released the port
+	pending  map[string]*pendingAuth
+}
+
+// pendingAuth is a browser authorization waiting for its callback
+type pendingAuth struct {
+	providerName string
+	config       *oauth2.Config
+	verifier     string
+	result       chan authResult
+}
+
+type authResult struct {
+	token *oauth2.Token
+	err   error
+}
+
+// oauthCallbackServer is shared by all browser based OAuth flows
+var oauthCallbackServer = &authServer{pending: map[string]*pendingAuth{}}
+
+// authPage is shown in the browser once the callback has been handled
+var authPage = template.Must(template.New("auth").Parse(`<!DOCTYPE html>
+<html>
+<head><title>discord-photo-reaper: {{.Title}}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto;">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+// fetchBrowserToken runs the authorization code flow with a random state and PKCE.
+// The user opens the logged URL in a browser, and the provider redirects back to config.RedirectURL on this server.
+func fetchBrowserToken(config *oauth2.Config, providerName string) (*oauth2.Token, error) {
+	return oauthCallbackServer.authorize(config, providerName)
+}
+
+func (a *authServer) authorize(config *oauth2.Config, providerName string) (*oauth2.Token, error) {
+	state, err := randomState()
+	if err != nil {
+		return nil, fmt.Errorf("error generating OAuth state: %v", err)
+	}
+
+	flow := &pendingAuth{
+		providerName: providerName,
+		config:       config,
+		verifier:     oauth2.GenerateVerifier(),
+		result:       make(chan authResult, 1),
+	}
+
+	if err := a.register(state, flow); err != nil {
+		return nil, err
+	}
+
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce, oauth2.S256ChallengeOption(flow.verifier))
+	log.Errorf("Go to the following link in your browser to authorize %s, and return:", providerName)
+	log.Errorf("%s", authURL)
+
+	result := <-flow.result
+	a.finish(state)
+
+	if result.err != nil {
+		return nil, result.err
+	}
+	log.Infof("Successfully obtained %s OAuth token", providerName)
+	return result.token, nil
+}
+
+// register adds a pending flow, starting the HTTP server if it isn't running
+func (a *authServer) register(state string, flow *pendingAuth) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for a.stopping != nil {
+		stopping := a.stopping
+		a.mu.Unlock()
+		<-stopping
+		a.mu.Lock()
+	}
+
+	if a.server == nil {
+		port := os.Getenv("HTTP_PORT")
+		if port == "" {
+			port = "8888"
+		}
+
+		listener, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			return fmt.Errorf("error starting OAuth callback server: %v", err)
+		}
+
+		a.server = &http.Server{Handler: http.HandlerFunc(a.handleCallback)}
+		go func(server *http.Server) {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Errorf("OAuth callback server stopped: %v", err)
+			}
+		}(a.server)
+		log.Debugf("OAuth callback server listening on :%s", port)
+	}
+
+	a.pending[state] = flow
+	return nil
+}
+
+// finish drops a completed flow and shuts the server down once nothing is pending
+func (a *authServer) finish(state string) {
+	a.mu.Lock()
+	delete(a.pending, state)
+	if len(a.pending) > 0 || a.server == nil {
+		a.mu.Unlock()
+		return
+	}
+
+	// Shut down without holding the lock, so requests still in flight (e.g. the browser's favicon) can complete
+	server, stopping := a.server, make(chan struct{})
+	a.server, a.stopping = nil, stopping
+	a.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warnf("Error shutting down OAuth callback server: %v", err)
+	}
+	log.Debugf("OAuth callback server stopped")
+
+	a.mu.Lock()
+	a.stopping = nil
+	a.mu.Unlock()
+	close(stopping)
+}
+
+// handleCallback validates the state of a redirect and exchanges its code for the matching flow
+func (a *authServer) handleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	a.mu.Lock()
+	flow, ok := a.pending[query.Get("state")]
+	if ok {
+		// A state is only good for one callback
+		delete(a.pending, query.Get("state"))
+	}
+	a.mu.Unlock()
+
+	if !ok {
+		renderAuthPage(w, http.StatusBadRequest, "Authorization failed", "This authorization link is unknown or has already been used. Restart the authorization from the link in the logs.")
+		return
+	}
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		err := fmt.Errorf("%s authorization was denied: %s %s", flow.providerName, providerErr, query.Get("error_description"))
+		flow.result <- authResult{err: err}
+		renderAuthPage(w, http.StatusBadRequest, "Authorization failed", err.Error())
+		return
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		err := fmt.Errorf("%s authorization code not found", flow.providerName)
+		flow.result <- authResult{err: err}
+		renderAuthPage(w, http.StatusBadRequest, "Authorization failed", err.Error())
+		return
+	}
+
+	token, err := flow.config.Exchange(r.Context(), code, oauth2.VerifierOption(flow.verifier))
+	if err != nil {
+		err = fmt.Errorf("error exchanging %s authorization code for token: %v", flow.providerName, err)
+		flow.result <- authResult{err: err}
+		renderAuthPage(w, http.StatusBadGateway, "Authorization failed", err.Error())
+		return
+	}
+
+	flow.result <- authResult{token: token}
+	renderAuthPage(w, http.StatusOK, "Authorization successful", fmt.Sprintf("%s is authorized. You can close this window.", flow.providerName))
+}
+
+func renderAuthPage(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := authPage.Execute(w, struct{ Title, Message string }{title, message}); err != nil {
+		log.Errorf("Error rendering OAuth callback page: %v", err)
+	}
+}
+
+// randomState returns an unguessable value binding a callback to the flow that started it
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
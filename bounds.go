@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordEpoch is the first millisecond of 2015, which Discord snowflakes count from
+const discordEpoch = 1420070400000
+
+// scanBounds limits a scan to messages whose IDs are at or above after, and below before. Zero leaves a side open.
+type scanBounds struct {
+	after  uint64
+	before uint64
+}
+
+// parseScanBounds reads SCAN_AFTER and SCAN_BEFORE for a guild
+func parseScanBounds(guildID string) (scanBounds, error) {
+	var bounds scanBounds
+	var err error
+	if bounds.after, err = parseScanBound(guildEnv(guildID, "SCAN_AFTER")); err != nil {
+		return bounds, fmt.Errorf("invalid SCAN_AFTER: %v", err)
+	}
+	if bounds.before, err = parseScanBound(guildEnv(guildID, "SCAN_BEFORE")); err != nil {
+		return bounds, fmt.Errorf("invalid SCAN_BEFORE: %v", err)
+	}
+	if bounds.after != 0 && bounds.before != 0 && bounds.after >= bounds.before {
+		return bounds, fmt.Errorf("SCAN_AFTER must be earlier than SCAN_BEFORE")
+	}
+	return bounds, nil
+}
+
+// parseScanBound turns a message ID, a date (2006-01-02) or an RFC 3339 timestamp into a snowflake.
+// A time becomes the first snowflake of its millisecond, so messages posted at that exact time are at the bound.
+func parseScanBound(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if snowflake, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return snowflake, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, value); err != nil {
+			return 0, fmt.Errorf("%q is neither a message ID, a date nor an RFC 3339 timestamp", value)
+		}
+	}
+	if t.UnixMilli() <= discordEpoch {
+		return 0, fmt.Errorf("%q is before Discord existed", value)
+	}
+	return timeToSnowflake(t), nil
+}
+
+// timeToSnowflake returns the first snowflake of the millisecond t falls in
+func timeToSnowflake(t time.Time) uint64 {
+	return uint64(t.UnixMilli()-discordEpoch) << 22
+}
+
+// beforeID returns the upper bound as a message ID to page back from, or "" to start at the newest message.
+// Discord's before parameter is exclusive, like the bound.
+func (b scanBounds) beforeID() string {
+	if b.before == 0 {
+		return ""
+	}
+	return strconv.FormatUint(b.before, 10)
+}
+
+// channelBefore reports whether a channel's newest message is already below the lower bound, so it has nothing to scan
+func (b scanBounds) channelBefore(channel *discordgo.Channel) bool {
+	last, err := strconv.ParseUint(channel.LastMessageID, 10, 64)
+	return b.after != 0 && err == nil && last < b.after
+}
+
+// trim drops the messages of a page, newest first, below the lower bound.
+// passed is true once the page reaches the lower bound, so older pages need not be fetched.
+func (b scanBounds) trim(messages []*discordgo.Message) (kept []*discordgo.Message, passed bool) {
+	if b.after == 0 {
+		return messages, false
+	}
+
+	for i, message := range messages {
+		id, err := strconv.ParseUint(message.ID, 10, 64)
+		if err == nil && id == b.after {
+			return messages[:i+1], true
+		}
+		if err == nil && id < b.after {
+			return messages[:i], true
+		}
+	}
+	return messages, false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// cdnURLExpiryMargin refreshes signed URLs a little before they expire, so they don't lapse mid-download
+const cdnURLExpiryMargin = time.Minute
+
+// attachmentEntity returns the state entity of an attachment: its URL without the query string.
+// Discord signs attachment URLs with ex, is and hm parameters that change whenever a URL is signed again.
+func attachmentEntity(rawURL string) string {
+	entity, _, _ := strings.Cut(rawURL, "?")
+	return entity
+}
+
+// cdnURLExpiry returns when a signed Discord CDN URL expires, read from its hex encoded "ex" parameter
+func cdnURLExpiry(rawURL string) (time.Time, bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	expiry, err := strconv.ParseInt(parsed.Query().Get("ex"), 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(expiry, 0), true
+}
+
+// cdnURLExpired reports whether a signed URL has expired, or is about to. Unsigned URLs never expire.
+func cdnURLExpired(rawURL string) bool {
+	expiry, signed := cdnURLExpiry(rawURL)
+	return signed && time.Now().Add(cdnURLExpiryMargin).After(expiry)
+}
+
+// refreshAttachmentURL returns a freshly signed URL for a job's attachment.
+// Discord's refresh-urls endpoint is tried first, then the message is fetched again.
+func refreshAttachmentURL(job *attachmentJob, rawURL string) (string, error) {
+	refreshed, err := refreshURLFromEndpoint(job.Session, rawURL)
+	if err == nil {
+		cdnURLRefreshes.WithLabelValues(job.Target.GuildID, "endpoint", "success").Add(1)
+		return refreshed, nil
+	}
+	cdnURLRefreshes.WithLabelValues(job.Target.GuildID, "endpoint", "failure").Add(1)
+	log.Debugf("Could not refresh %s through the refresh-urls endpoint: %v", rawURL, err)
+
+	refreshed, err = refreshURLFromMessage(job)
+	if err == nil {
+		cdnURLRefreshes.WithLabelValues(job.Target.GuildID, "message", "success").Add(1)
+		return refreshed, nil
+	}
+	cdnURLRefreshes.WithLabelValues(job.Target.GuildID, "message", "failure").Add(1)
+	return "", err
+}
+
+// refreshURLFromEndpoint asks Discord to re-sign an attachment URL
+func refreshURLFromEndpoint(dg *discordgo.Session, rawURL string) (string, error) {
+	endpoint := discordgo.EndpointAPI + "attachments/refresh-urls"
+	body, err := dg.RequestWithBucketID("POST", endpoint, map[string][]string{"attachment_urls": {rawURL}}, endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		RefreshedURLs []struct {
+			Original  string `json:"original"`
+			Refreshed string `json:"refreshed"`
+		} `json:"refreshed_urls"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("error decoding refresh-urls response: %v", err)
+	}
+
+	for _, refreshed := range response.RefreshedURLs {
+		if refreshed.Refreshed != "" {
+			return refreshed.Refreshed, nil
+		}
+	}
+	return "", fmt.Errorf("no refreshed URL returned")
+}
+
+// refreshURLFromMessage fetches the job's message again, which carries freshly signed attachment URLs
+func refreshURLFromMessage(job *attachmentJob) (string, error) {
+	message, err := job.Session.ChannelMessage(job.Channel.ID, job.Message.ID)
+	if err != nil {
+		return "", fmt.Errorf("error fetching message %s: %v", job.Message.ID, err)
+	}
+
+	for _, attachment := range message.Attachments {
+		if attachment.ID == job.Attachment.ID {
+			return attachment.URL, nil
+		}
+	}
+	return "", fmt.Errorf("attachment %s is no longer on message %s", job.Attachment.ID, job.Message.ID)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand runs the maintenance command named by the first argument instead of archiving
+func runCommand(args []string) {
+	switch args[0] {
+	case "reconcile":
+		reconcileCommand(args[1:])
+	case "migrate":
+		migrateCommand(args[1:])
+	case "deadletters":
+		deadLettersCommand(args[1:])
+	case "optout":
+		optOutCommand(args[1:])
+	case "purge":
+		purgeCommand(args[1:])
+	default:
+		log.Fatalf("Unknown command: %s. Valid commands are 'reconcile', 'migrate', 'deadletters', 'optout' or 'purge'", args[0])
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deadLettersCommand lists, retries or purges attachments that used up their retry attempts.
+// Retry and purge act on the attachment IDs given, or on every dead letter when none are.
+func deadLettersCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: deadletters list|retry|purge [-pending] [attachment id...]")
+	}
+	action := args[0]
+
+	flags := flag.NewFlagSet("deadletters "+action, flag.ExitOnError)
+	pending := flags.Bool("pending", false, "act on attachments still being retried instead of dead letters")
+	flags.Parse(args[1:])
+	ids := flags.Args()
+
+	dg, targets := setup()
+	defer dg.Close()
+
+	selected := func(target *GuildTarget) []*FailedJob {
+		jobs := target.Retries.list(target.GuildID, !*pending)
+		if len(ids) == 0 {
+			return jobs
+		}
+		return slices.DeleteFunc(jobs, func(job *FailedJob) bool { return !slices.Contains(ids, job.AttachmentID) })
+	}
+
+	switch action {
+	case "list":
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(out, "ATTACHMENT\tGUILD\tCHANNEL\tMESSAGE\tFILENAME\tCLASS\tSTATUS\tATTEMPTS\tLAST FAILURE\tNEXT RETRY\tERROR")
+		for _, target := range targets {
+			for _, job := range selected(target) {
+				fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+					job.AttachmentID, job.GuildID, job.ChannelID, job.MessageID, job.Filename, job.ErrorClass, job.Status,
+					job.Attempts, job.LastFailure.Format(time.RFC3339), job.NextRetry.Format(time.RFC3339), job.Error)
+			}
+		}
+		out.Flush()
+	case "retry":
+		for _, target := range targets {
+			for _, job := range selected(target) {
+				log.Infof("Retrying %s (%s)", job.Filename, job.AttachmentID)
+				retryFailedJob(dg, target, job)
+			}
+		}
+	case "purge":
+		for _, target := range targets {
+			jobs := selected(target)
+			target.Retries.purge(jobs)
+			log.Infof("Purged %d attachments of guild %s from the retry queue", len(jobs), target.GuildID)
+		}
+	default:
+		log.Fatalf("Unknown deadletters action: %s. Valid actions are 'list', 'retry' or 'purge'", action)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
 	"sync"
@@ -12,8 +13,17 @@ import (
 )
 
 // Scans a channel, fetching all messages and processing them
-func scanChannel(dg *discordgo.Session, channelId string, storage StorageProvider) {
-	var lastMessageId string
+func scanChannel(dg *discordgo.Session, channel *discordgo.Channel, target *GuildTarget) {
+	channelId := channel.ID
+	bounds := target.Bounds
+	if bounds.channelBefore(channel) {
+		log.Debugf("Skipping channel %s, it has no messages after the scan bound", channelId)
+		return
+	}
+	updateRunStatus(target.GuildID, func(status *runStatus) { status.Channels++ })
+
+	// Pages are fetched newest first, starting at the upper bound
+	lastMessageId := bounds.beforeID()
 	var wg sync.WaitGroup
 
 	maxConcurrentGoroutines := 5
@@ -30,39 +40,37 @@ func scanChannel(dg *discordgo.Session, channelId string, storage StorageProvide
 	semaphore := make(chan struct{}, maxConcurrentGoroutines)
 
 	for {
+		// Rate limits and server errors are already waited out and retried by the session's transport
 		messages, err := dg.ChannelMessages(channelId, 100, lastMessageId, "", "")
 		if err != nil {
-			// Handle rate limits by retrying after a delay
-			if discordErr, ok := err.(*discordgo.RESTError); ok && discordErr.Response.StatusCode == 429 {
-				retryAfter := discordErr.Response.Header.Get("Retry-After")
-				waitDuration, err := time.ParseDuration(retryAfter + "ms")
-				if err == nil {
-					log.Warnf("Rate limit encountered, retrying after %s", waitDuration.String())
-					time.Sleep(waitDuration)
-					continue
-				}
-			} else {
-				log.Errorf("Failed to fetch messages in channel %s: %v", channelId, err)
-				break
-			}
+			log.Errorf("Failed to fetch messages in channel %s: %v", channelId, err)
+			break
 		}
 
 		if len(messages) == 0 {
 			log.Infof("Completed scan for channel %s", channelId)
 			break
 		}
+		oldestMessageId := messages[len(messages)-1].ID
+
+		messages, passedLowerBound := bounds.trim(messages)
+		if len(messages) > 0 {
+			semaphore <- struct{}{}
+			wg.Add(1)
+
+			go func(messages []*discordgo.Message, target *GuildTarget) {
+				defer wg.Done()                // Signal completion
+				defer func() { <-semaphore }() // Release semaphore slot
+				log.Debugf("Start scanner for batch %s %s", channelId, lastMessageId)
+				scanMessages(dg, target, channel, messages)
+			}(messages, target)
+		}
 
-		semaphore <- struct{}{}
-		wg.Add(1)
-
-		go func(messages []*discordgo.Message, storage StorageProvider) {
-			defer wg.Done()                // Signal completion
-			defer func() { <-semaphore }() // Release semaphore slot
-			log.Debugf("Start scanner for batch %s %s", channelId, lastMessageId)
-			scanMessages(storage, messages)
-		}(messages, storage)
-
-		lastMessageId = messages[len(messages)-1].ID
+		if passedLowerBound {
+			log.Infof("Completed scan for channel %s, reached the lower scan bound", channelId)
+			break
+		}
+		lastMessageId = oldestMessageId
 	}
 
 	wg.Wait()
@@ -76,6 +84,11 @@ func initDiscordGo(token string) *discordgo.Session {
 	intents := discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages | discordgo.IntentsMessageContent
 	dg.Identify.Intents = intents
 
+	// Route every REST call through one transport that owns rate limit waits and retries
+	dg.Client = &http.Client{Transport: newDiscordTransport()}
+	dg.ShouldRetryOnRateLimit = false
+	dg.MaxRestRetries = 0
+
 	err = dg.Open()
 	if err != nil {
 		Fail(fmt.Sprintf("error opening connection %v", err))
@@ -84,40 +97,92 @@ func initDiscordGo(token string) *discordgo.Session {
 	return dg
 }
 
-func getChannelIds(dg *discordgo.Session, guildId string) []string {
+func getChannels(dg *discordgo.Session, guildId string) []*discordgo.Channel {
 	channels, err := dg.GuildChannels(guildId)
 	if err != nil {
 		log.Fatalf("Error fetching channels for guild %s: %v", guildId, err)
 	}
 
-	channelIds := []string{}
-
-	// Add the channel IDs to our list
 	for _, channel := range channels {
 		log.Debugf("Got channel %s %s", channel.Name, channel.ID)
-		channelIds = append(channelIds, channel.ID)
 	}
 
 	log.Infof("Got all channels")
-	return channelIds
+	return channels
+}
+
+// memberRolesCache holds the role IDs of members looked up during this process, keyed by guild and user
+var memberRolesCache sync.Map
+
+// memberRoles returns the role IDs held by a user in a guild, preferring the gateway state cache
+func memberRoles(dg *discordgo.Session, guildId, userId string) []string {
+	cacheKey := guildId + "/" + userId
+	if roles, ok := memberRolesCache.Load(cacheKey); ok {
+		return roles.([]string)
+	}
+
+	member, err := dg.State.Member(guildId, userId)
+	if err != nil {
+		member, err = dg.GuildMember(guildId, userId)
+		if err != nil {
+			// Users who have left the guild have no roles
+			log.Debugf("Could not look up member %s in guild %s: %v", userId, guildId, err)
+			memberRolesCache.Store(cacheKey, []string{})
+			return []string{}
+		}
+	}
+
+	memberRolesCache.Store(cacheKey, member.Roles)
+	return member.Roles
 }
 
-func scanMessages(storage StorageProvider, messages []*discordgo.Message) {
+func scanMessages(dg *discordgo.Session, target *GuildTarget, channel *discordgo.Channel, messages []*discordgo.Message) {
 	start := time.Now()
 	for _, message := range messages {
 		log.Debugf("Message: %v", message)
+
+		if len(message.Attachments) == 0 {
+			continue
+		}
+
+		var roles []string
+		if message.Author != nil && (target.Router.needsRoles() || target.Selection.needsRoles()) {
+			roles = memberRoles(dg, target.GuildID, message.Author.ID)
+		}
+
+		if selected, reason := target.selects(message, roles); !selected {
+			log.Debugf("Skipping message %s, not selected by %s", message.ID, reason)
+			messagesSkipped.WithLabelValues(target.GuildID, reason).Add(1)
+			files.WithLabelValues(target.GuildID, channel.ID, fileFiltered).Add(float64(len(message.Attachments)))
+			updateRunStatus(target.GuildID, func(status *runStatus) { status.Skipped++ })
+			continue
+		}
+
 		for _, attachment := range message.Attachments {
 			log.Debugf("Attachment: %v", attachment)
-			log.Debugf("Start download for file %s %s", attachment.URL, attachment.Filename)
-			download(
-				attachment.URL,
-				attachment.Filename,
-				attachment.ContentType,
-				attachment.Size,
-				storage,
-			)
+			// Failed attachments are left to the retry queue's backoff, and dead letters to a manual retry
+			if failed, held := target.Retries.holds(attachment.ID, time.Now()); held {
+				if failed.Dead {
+					log.Debugf("Skipping %s, it is a dead letter", attachment.Filename)
+				} else {
+					log.Debugf("Skipping %s, it is queued for retry at %s", attachment.Filename, failed.NextRetry.Format(time.RFC3339))
+				}
+				continue
+			}
+			job := &attachmentJob{
+				Session:    dg,
+				Target:     target,
+				Channel:    channel,
+				Message:    message,
+				Attachment: attachment,
+				Roles:      roles,
+			}
+			storage := target.Router.Route(job)
+			log.Debugf("Start download for file %s %s to %s", attachment.URL, attachment.Filename, storage.GetName())
+			download(job, storage)
 		}
 	}
-	messagesChecked.Add(float64(len(messages)))
-	batchProcessingTime.WithLabelValues().Observe(float64(time.Since(start).Seconds()))
+	messagesChecked.WithLabelValues(target.GuildID, channel.ID).Add(float64(len(messages)))
+	updateRunStatus(target.GuildID, func(status *runStatus) { status.Messages += len(messages) })
+	batchProcessingTime.WithLabelValues(target.GuildID).Observe(float64(time.Since(start).Seconds()))
 }
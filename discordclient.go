@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// discordTransport carries every Discord REST call the session makes.
+// discordgo already waits out per-route buckets from the rate limit headers; the transport adds what it doesn't do:
+// waiting out 429s (Retry-After is in seconds) and global limits across all routes, retrying server errors with
+// backoff, and reporting all of it in metrics.
+type discordTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+
+	mu          sync.Mutex
+	globalUntil time.Time // no request is sent before this time after a global rate limit
+}
+
+// newDiscordTransport creates a transport retrying up to DISCORD_MAX_RETRIES (default 5) times per request
+func newDiscordTransport() *discordTransport {
+	maxRetries := 5
+	if os.Getenv("DISCORD_MAX_RETRIES") != "" {
+		var err error
+		maxRetries, err = strconv.Atoi(os.Getenv("DISCORD_MAX_RETRIES"))
+		if err != nil {
+			log.Fatalf("Invalid DISCORD_MAX_RETRIES: %v", err)
+		}
+	}
+	// Waits and retries happen inside a single client call, so only each attempt is bounded in time
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.ResponseHeaderTimeout = 20 * time.Second
+	return &discordTransport{base: base, maxRetries: maxRetries}
+}
+
+// snowflakePattern matches the IDs in a route, which are replaced to keep metric labels bounded
+var snowflakePattern = regexp.MustCompile(`/\d{15,}`)
+
+// discordRoute returns the route of a request path with IDs replaced, e.g. /api/v9/channels/:id/messages.
+// Interaction and webhook tokens, which follow the interaction or webhook ID, are replaced too so they never reach a label.
+func discordRoute(path string) string {
+	segments := strings.Split(snowflakePattern.ReplaceAllString(path, "/:id"), "/")
+	for i := 2; i < len(segments); i++ {
+		if (segments[i-2] == "interactions" || segments[i-2] == "webhooks") && segments[i-1] == ":id" && segments[i] != ":id" {
+			segments[i] = ":token"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// RoundTrip sends a request, waiting out rate limits and retrying server errors
+func (t *discordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	route := discordRoute(req.URL.Path)
+
+	for attempt := 0; ; attempt++ {
+		if err := t.waitGlobal(req, route); err != nil {
+			return nil, err
+		}
+
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		discordRequests.WithLabelValues(route, discordStatusLabel(resp, err)).Add(1)
+		if attempt >= t.maxRetries {
+			return resp, err
+		}
+
+		var wait time.Duration
+		var reason string
+		switch {
+		case err != nil:
+			if !idempotentMethod(req.Method) {
+				return nil, err
+			}
+			wait, reason = retryBackoffDuration(attempt), "network"
+		case resp.StatusCode == http.StatusTooManyRequests:
+			wait, reason = t.rateLimited(resp, route), "rate_limit"
+		case resp.StatusCode >= 500 && idempotentMethod(req.Method):
+			wait, reason = retryBackoffDuration(attempt), "server_error"
+		default:
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		discordRetries.WithLabelValues(route, reason).Add(1)
+		log.Warnf("Discord request %s %s failed (%s), retrying in %s", req.Method, route, reason, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// rateLimited reads how long a 429 asks to wait, and blocks every route when the limit is global
+func (t *discordTransport) rateLimited(resp *http.Response, route string) time.Duration {
+	// Retry-After is in seconds, and may carry a fraction
+	wait := time.Second
+	if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+		wait = time.Duration(seconds * float64(time.Second))
+	}
+
+	scope := resp.Header.Get("X-RateLimit-Scope")
+	if scope == "" {
+		scope = "user"
+	}
+	if resp.Header.Get("X-RateLimit-Global") == "true" {
+		scope = "global"
+		t.mu.Lock()
+		t.globalUntil = time.Now().Add(wait)
+		t.mu.Unlock()
+	}
+
+	discordRateLimitWaits.WithLabelValues(route, scope).Add(1)
+	discordRateLimitWaitSeconds.WithLabelValues(route).Add(wait.Seconds())
+	return wait
+}
+
+// waitGlobal holds a request back while a global rate limit is in effect
+func (t *discordTransport) waitGlobal(req *http.Request, route string) error {
+	t.mu.Lock()
+	wait := time.Until(t.globalUntil)
+	t.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	discordRateLimitWaits.WithLabelValues(route, "global").Add(1)
+	discordRateLimitWaitSeconds.WithLabelValues(route).Add(wait.Seconds())
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// retryBackoffDuration doubles from one second with every attempt, up to a minute
+func retryBackoffDuration(attempt int) time.Duration {
+	if attempt >= 6 {
+		return time.Minute
+	}
+	return time.Second << attempt
+}
+
+// idempotentMethod reports whether a request can safely be sent again after it may have reached Discord
+func idempotentMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodPut || method == http.MethodDelete
+}
+
+// discordStatusLabel returns the status code of a response for metrics, or "error" when none arrived
+func discordStatusLabel(resp *http.Response, err error) string {
+	if err != nil || resp == nil {
+		return "error"
+	}
+	return strconv.Itoa(resp.StatusCode)
+}
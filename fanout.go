@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TrackedStorageProvider is implemented by providers that record per-destination progress in the state store,
+// so a partially completed upload only retries the destinations that are still missing.
+type TrackedStorageProvider interface {
+	StorageProvider
+
+	// UploadTracked uploads to every destination that hasn't recorded entity yet.
+	// complete is true once every destination holds the file.
+	UploadTracked(data *bytes.Buffer, filename, entity string, state *StateStore) (complete bool, err error)
+}
+
+// fanOutMember is a named storage destination taking part in a fan-out upload
+type fanOutMember struct {
+	name    string
+	storage StorageProvider
+}
+
+// FanOutStorage implements StorageProvider by uploading every file to several destinations for redundancy
+type FanOutStorage struct {
+	members    []fanOutMember
+	minSuccess int
+}
+
+// NewFanOutStorage creates a fan-out provider over the named destinations in registry.
+// minSuccess is the number of destinations that must succeed for an upload to count; 0 requires all of them.
+func NewFanOutStorage(targets []string, minSuccess int, registry map[string]StorageProvider) *FanOutStorage {
+	members := []fanOutMember{}
+	for _, name := range targets {
+		storage, ok := registry[name]
+		if !ok {
+			log.Fatalf("Fan-out target %q is not a known storage destination", name)
+		}
+		members = append(members, fanOutMember{name: name, storage: storage})
+	}
+
+	if len(members) == 0 {
+		log.Fatalf("Fan-out storage needs at least one target. Set STORAGE_TARGETS")
+	}
+	if minSuccess <= 0 || minSuccess > len(members) {
+		minSuccess = len(members)
+	}
+
+	return &FanOutStorage{members: members, minSuccess: minSuccess}
+}
+
+// newFanOutStorageFromEnv reads the fan-out targets and policy from env
+func newFanOutStorageFromEnv(env func(string) string, registry map[string]StorageProvider) *FanOutStorage {
+	targets := []string{}
+	for _, name := range strings.Split(env("STORAGE_TARGETS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			targets = append(targets, name)
+		}
+	}
+
+	minSuccess := 0
+	if env("STORAGE_MIN_SUCCESS") != "" {
+		var err error
+		minSuccess, err = strconv.Atoi(env("STORAGE_MIN_SUCCESS"))
+		if err != nil {
+			log.Fatalf("Invalid STORAGE_MIN_SUCCESS: %v", err)
+		}
+	}
+
+	return NewFanOutStorage(targets, minSuccess, registry)
+}
+
+// Upload uploads a file to every destination without tracking per-destination progress.
+// Every destination is sent the same bytes, so the file is read into memory first.
+// Each destination's upload is verified individually, so the result carries no checksums of its own.
+func (f *FanOutStorage) Upload(data io.Reader, filename string) (*RemoteFile, error) {
+	payload, err := io.ReadAll(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s for upload: %v", filename, err)
+	}
+	_, err = f.upload(payload, filename, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteFile{Name: filename}, nil
+}
+
+// UploadTracked uploads a file to every destination that hasn't already received it
+func (f *FanOutStorage) UploadTracked(data *bytes.Buffer, filename, entity string, state *StateStore) (bool, error) {
+	return f.upload(data.Bytes(), filename, entity, state)
+}
+
+// Stat returns the file at a path from the first destination holding it.
+// IDs differ between destinations, so files can't be looked up by ID.
+func (f *FanOutStorage) Stat(ref FileRef) (*RemoteFile, error) {
+	if ref.ID != "" {
+		return nil, fmt.Errorf("%s can't look files up by ID", f.GetName())
+	}
+
+	for _, member := range f.members {
+		remote, err := member.storage.Stat(ref)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", member.name, err)
+		}
+		return remote, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// Open reads the file at a path from the first destination holding it
+func (f *FanOutStorage) Open(ref FileRef) (io.ReadCloser, error) {
+	if ref.ID != "" {
+		return nil, fmt.Errorf("%s can't look files up by ID", f.GetName())
+	}
+
+	for _, member := range f.members {
+		file, err := member.storage.Open(ref)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", member.name, err)
+		}
+		return file, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// Exists reports whether any destination holds a file at the path
+func (f *FanOutStorage) Exists(ref FileRef) (bool, error) {
+	return statExists(f.Stat(ref))
+}
+
+// List isn't supported for fan-out storage as a whole, since every destination holds its own copy.
+// Reconciliation lists each destination separately.
+func (f *FanOutStorage) List(pageToken string) ([]*RemoteFile, string, error) {
+	return nil, "", fmt.Errorf("%s can't be listed as a whole, list its destinations instead", f.GetName())
+}
+
+// Delete removes the file at a path from every destination holding it
+func (f *FanOutStorage) Delete(ref FileRef) error {
+	if ref.ID != "" {
+		return fmt.Errorf("%s can't delete files by ID", f.GetName())
+	}
+
+	deleted := 0
+	errs := []string{}
+	for _, member := range f.members {
+		err := member.storage.Delete(ref)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", member.name, err))
+			continue
+		}
+		deleted++
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("deleting %s: %s", ref.Path, strings.Join(errs, "; "))
+	}
+	if deleted == 0 {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// Capabilities describes what every destination supports.
+// Checksums are verified per destination, so none are reported for the fan-out as a whole.
+func (f *FanOutStorage) Capabilities() StorageCapabilities {
+	capabilities := StorageCapabilities{StatByPath: true, Delete: true}
+	for _, member := range f.members {
+		memberCapabilities := member.storage.Capabilities()
+		capabilities.StatByPath = capabilities.StatByPath && memberCapabilities.StatByPath
+		capabilities.Delete = capabilities.Delete && memberCapabilities.Delete
+		if limit := memberCapabilities.MaxUploadSize; limit > 0 && (capabilities.MaxUploadSize == 0 || limit < capabilities.MaxUploadSize) {
+			capabilities.MaxUploadSize = limit
+		}
+	}
+	return capabilities
+}
+
+// GetName returns the storage provider name
+func (f *FanOutStorage) GetName() string {
+	names := []string{}
+	for _, member := range f.members {
+		names = append(names, member.name)
+	}
+	return fmt.Sprintf("Fan-out (%s)", strings.Join(names, ", "))
+}
+
+func (f *FanOutStorage) upload(payload []byte, filename, entity string, state *StateStore) (bool, error) {
+	succeeded := 0
+	errs := []string{}
+
+	for _, member := range f.members {
+		memberEntity := member.name + " " + entity
+		if state != nil && state.checkOk(memberEntity) {
+			log.Debugf("File %s already uploaded to %s", filename, member.name)
+			succeeded++
+			continue
+		}
+
+		if _, err := uploadVerified(member.storage, payload, filename); err != nil {
+			log.Warnf("Fan-out upload of %s to %s failed: %v", filename, member.name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", member.name, err))
+			continue
+		}
+
+		succeeded++
+		if state != nil {
+			state.recordOk(memberEntity)
+		}
+	}
+
+	if succeeded < f.minSuccess {
+		return false, fmt.Errorf("uploaded %s to %d of %d destinations, need %d: %s", filename, succeeded, len(f.members), f.minSuccess, strings.Join(errs, "; "))
+	}
+	return succeeded == len(f.members), nil
+}
@@ -2,63 +2,265 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 	log "github.com/sirupsen/logrus"
 )
 
-// download downloads the content from the URL into memory and checks its integrity
-func download(url, name, expectedContentType string, expectedFileSize int, storage StorageProvider) {
-	if checkOk(url) {
+// download downloads an attachment into memory, checks its integrity and uploads it to storage
+func download(job *attachmentJob, storage StorageProvider) {
+	target := job.Target
+	url := job.Attachment.URL
+	entity := attachmentEntity(url)
+	expectedContentType := job.Attachment.ContentType
+
+	if target.State.checkOk(entity) {
 		log.Debugf("File already downloaded %s", url)
+		target.Retries.succeed(job.Attachment.ID)
 		return // Already downloaded
 	}
+	defer startTransfer(job, storage)()
+
+	start := time.Now()
+	fetchURL := url
+	if cdnURLExpired(fetchURL) {
+		log.Debugf("Attachment URL %s has expired, refreshing it", url)
+		if refreshed, err := refreshAttachmentURL(job, fetchURL); err != nil {
+			log.Warnf("Could not refresh expired attachment URL %s: %v", url, err)
+		} else {
+			fetchURL = refreshed
+		}
+	}
 
-	resp, err := http.Get(url)
+	resp, err := fetchAttachment(fetchURL)
 	if err != nil {
-		log.Errorf("error downloading file from %s: %v", url, err)
+		failDownload(job, failureDownload, 0, fmt.Errorf("error downloading file from %s: %v", url, err))
 		return
 	}
+
+	// Signed URLs can also lapse between listing a message and downloading its attachments
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		log.Debugf("HTTP status code %d while downloading file from %s, refreshing its URL", resp.StatusCode, url)
+
+		refreshed, err := refreshAttachmentURL(job, fetchURL)
+		if err != nil {
+			failDownload(job, failureHTTPStatus, resp.StatusCode, fmt.Errorf("HTTP status code %d while downloading file from %s, and its URL could not be refreshed: %v", resp.StatusCode, url, err))
+			return
+		}
+		if resp, err = fetchAttachment(refreshed); err != nil {
+			failDownload(job, failureDownload, 0, fmt.Errorf("error downloading file from %s: %v", url, err))
+			return
+		}
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Errorf("HTTP status code %d while downloading file from %s", resp.StatusCode, url)
+		failDownload(job, failureHTTPStatus, resp.StatusCode, fmt.Errorf("HTTP status code %d while downloading file from %s", resp.StatusCode, url))
 		return
 	}
 
 	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, resp.Body); err != nil {
-		log.Errorf("error copying content to buffer: %v", err)
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(&buf, hasher), resp.Body); err != nil {
+		failDownload(job, failureDownload, 0, fmt.Errorf("error copying content to buffer: %v", err))
 		return
 	}
+	downloadDuration.WithLabelValues("Discord").Observe(time.Since(start).Seconds())
+	downloadBytes.WithLabelValues("Discord").Add(float64(buf.Len()))
 
 	contentType := resp.Header.Get("Content-Type")
 	if contentType != expectedContentType && expectedContentType != "" {
 		log.Warnf("unexpected content-type: expected %s, got %s", expectedContentType, contentType)
 	}
 
-	// This never matches...
-	// if buf.Len() != expectedFileSize {
-	// 	log.Errorf("file size mismatch: expected %d bytes, got %d bytes", expectedFileSize, buf.Len())
-	// 	return
-	// }
+	// A short read is left unrecorded and queued, so the attachment is downloaded again
+	if job.Attachment.Size > 0 && buf.Len() != job.Attachment.Size {
+		downloadSizeMismatches.WithLabelValues(target.GuildID).Add(1)
+		failDownload(job, failureSizeMismatch, 0, fmt.Errorf("file size mismatch for %s: expected %d bytes, got %d bytes", url, job.Attachment.Size, buf.Len()))
+		return
+	}
 
 	// Try to determine the content-type from the data itself
 	mimeType := mimetype.Detect(buf.Bytes())
 	if !strings.HasPrefix(mimeType.String(), expectedContentType) {
 		log.Warnf("content-type mismatch: expected %s, detected %s", expectedContentType, mimeType.String())
 	}
+	// Text where media was expected is an error page served in place of the file
+	if isMediaType(expectedContentType) && strings.HasPrefix(mimeType.String(), "text/") {
+		failDownload(job, failureMimeMismatch, 0, fmt.Errorf("expected %s from %s, got %s", expectedContentType, url, mimeType.String()))
+		return
+	}
+
+	record := newFileRecord(job, storage, hex.EncodeToString(hasher.Sum(nil)), buf.Len())
+	if original, ok := target.State.lookupHash(record.SHA256); ok && original.Entity != entity {
+		mode := guildEnv(target.GuildID, "DEDUPE_MODE")
+		if mode == "" {
+			mode = "off"
+		}
+		dedupeHits.WithLabelValues(target.GuildID, mode).Add(1)
 
-	// Upload to configured storage provider
-	err = storage.Upload(&buf, name)
+		switch mode {
+		case "skip":
+			log.Infof("Skipping %s, identical to already archived %s", url, original.Entity)
+			target.State.recordOk(entity)
+			target.Retries.succeed(job.Attachment.ID)
+			countFile(target.GuildID, job.Channel.ID, fileSkippedDedupe)
+			updateRunStatus(target.GuildID, func(status *runStatus) { status.Duplicates++ })
+			return
+		case "reference":
+			log.Infof("Recording %s as a reference to already archived %s", url, original.Entity)
+			record.Type = recordTypeDuplicate
+			record.DuplicateOf = original.Entity
+			record.Destination = original.Destination
+			target.State.recordFile(record)
+			target.Retries.succeed(job.Attachment.ID)
+			countFile(target.GuildID, job.Channel.ID, fileSkippedDedupe)
+			updateRunStatus(target.GuildID, func(status *runStatus) { status.Duplicates++ })
+			return
+		}
+	}
+
+	uploadName, skip := checkNearDuplicate(job, record, buf.Bytes(), mimeType.String())
+	if skip {
+		target.Retries.succeed(job.Attachment.ID)
+		countFile(target.GuildID, job.Channel.ID, fileSkippedDedupe)
+		updateRunStatus(target.GuildID, func(status *runStatus) { status.Duplicates++ })
+		return
+	}
+	record.Path = uploadName
+
+	// Providers tracking their own destinations only mark the file done once every destination holds it
+	if tracked, ok := storage.(TrackedStorageProvider); ok {
+		complete, err := tracked.UploadTracked(&buf, uploadName, entity, target.State)
+		if err != nil {
+			failDownload(job, failureUpload, 0, fmt.Errorf("error uploading %s to %s: %v", url, storage.GetName(), err))
+			return
+		}
+		// A partial upload is retried, so the file is only counted once it reached every destination
+		if !complete {
+			log.Warnf("File %s reached only some destinations of %s, the rest will be retried", url, storage.GetName())
+			target.Retries.fail(job, failureUpload, 0, fmt.Errorf("only some destinations of %s hold the file", storage.GetName()))
+			return
+		}
+		countFile(target.GuildID, job.Channel.ID, fileUploaded)
+		updateRunStatus(target.GuildID, func(status *runStatus) {
+			status.Uploaded++
+			status.Bytes += int64(buf.Len())
+		})
+		target.State.recordFile(record)
+		target.Retries.succeed(job.Attachment.ID)
+		return
+	}
+
+	// Upload to configured storage provider, checking what it stored against what was downloaded
+	remote, err := uploadVerified(storage, buf.Bytes(), uploadName)
 	if err != nil {
-		log.Errorf("Error uploading %s to %s: %v", url, storage.GetName(), err)
+		failDownload(job, failureUpload, 0, fmt.Errorf("error uploading %s to %s: %v", url, storage.GetName(), err))
 		return
 	}
-	uploadedFiles.Add(1)
+	countFile(target.GuildID, job.Channel.ID, fileUploaded)
+	updateRunStatus(target.GuildID, func(status *runStatus) {
+		status.Uploaded++
+		status.Bytes += int64(buf.Len())
+	})
 
-	recordOk(url)
+	record.RemoteID = remote.ID
+	// Providers that don't overwrite may have stored the file under another name
+	if remote.Path != "" {
+		record.Path = remote.Path
+	}
+	target.State.recordFile(record)
+	target.Retries.succeed(job.Attachment.ID)
+}
+
+// failDownload logs why an attachment couldn't be archived and queues it to be retried with backoff
+func failDownload(job *attachmentJob, class string, status int, err error) {
+	log.Errorf("%v", err)
+	job.Target.Retries.fail(job, class, status, err)
+}
+
+// isMediaType reports whether a content type is an image, video or audio type
+func isMediaType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "video/") || strings.HasPrefix(contentType, "audio/")
+}
+
+// fetchAttachment requests an attachment from the Discord CDN
+func fetchAttachment(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Ask for the stored bytes as is. Go transparently decompresses gzip responses it requested itself,
+	// which left the byte count differing from the attachment size Discord reports.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	return http.DefaultClient.Do(req)
+}
+
+// checkNearDuplicate perceptually hashes image attachments and applies PHASH_MODE when an earlier upload looks the same.
+// It returns the name to upload the file under, or skip when the file should not be uploaded at all.
+func checkNearDuplicate(job *attachmentJob, record *FileRecord, data []byte, detectedType string) (uploadName string, skip bool) {
+	target := job.Target
+	uploadName = job.Attachment.Filename
+
+	settings := target.PHash
+	if settings == nil || !strings.HasPrefix(detectedType, "image/") {
+		return uploadName, false
+	}
+
+	phash, err := computePerceptualHash(data, settings.algorithm)
+	if err != nil {
+		log.Debugf("Could not perceptually hash %s: %v", record.Entity, err)
+		return uploadName, false
+	}
+	record.PHash = phash
+
+	original, distance, ok := target.State.lookupPerceptualHash(phash, settings.maxDistance)
+	if !ok || original.Entity == record.Entity {
+		return uploadName, false
+	}
+
+	log.Infof("%s looks like already archived %s (distance %d)", record.Entity, original.Entity, distance)
+	nearDuplicateHits.WithLabelValues(target.GuildID, settings.mode).Add(1)
+	record.NearDuplicateOf = original.Entity
+	record.PHashDistance = distance
+
+	switch settings.mode {
+	case "skip":
+		record.Type = recordTypeDuplicate
+		record.DuplicateOf = original.Entity
+		record.Destination = original.Destination
+		target.State.recordFile(record)
+		return uploadName, true
+	case "duplicates":
+		return "duplicates/" + uploadName, false
+	}
+	return uploadName, false
+}
+
+// newFileRecord describes an attachment about to be archived to storage
+func newFileRecord(job *attachmentJob, storage StorageProvider, hash string, size int) *FileRecord {
+	record := &FileRecord{
+		Type:        recordTypeFile,
+		Entity:      attachmentEntity(job.Attachment.URL),
+		SHA256:      hash,
+		Size:        size,
+		Filename:    job.Attachment.Filename,
+		Destination: job.Target.Router.destinationName(storage),
+		GuildID:     job.Target.GuildID,
+		ChannelID:   job.Channel.ID,
+		MessageID:   job.Message.ID,
+	}
+	if job.Message.Author != nil {
+		record.AuthorID = job.Message.Author.ID
+	}
+	return record
 }
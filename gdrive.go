@@ -1,185 +1,352 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
-	"time"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
+// GoogleDriveConfig holds the settings for a Google Drive storage provider
+type GoogleDriveConfig struct {
+	CredentialsFile string
+	TokenFile       string
+	Folder          string
+	AuthFlow        string
+
+	// ImpersonateUser is the user a service account acts as through domain-wide delegation
+	ImpersonateUser string
+	// SharedDriveID places the folder in a Shared Drive instead of My Drive
+	SharedDriveID string
+}
+
 // GoogleDriveStorage implements StorageProvider for Google Drive
 type GoogleDriveStorage struct {
 	service *drive.Service
+	folder  string
+	driveID string
 }
 
 // NewGoogleDriveStorage creates a new Google Drive storage provider
-func NewGoogleDriveStorage(credentialsFile, tokenFile string) *GoogleDriveStorage {
-	service := initGDriveSvc(credentialsFile, tokenFile)
-	return &GoogleDriveStorage{service: service}
+func NewGoogleDriveStorage(config GoogleDriveConfig) *GoogleDriveStorage {
+	service := initGDriveSvc(config)
+	return &GoogleDriveStorage{service: service, folder: config.Folder, driveID: config.SharedDriveID}
 }
 
 // Upload uploads a file to Google Drive
-func (g *GoogleDriveStorage) Upload(data *bytes.Buffer, filename string) error {
-	return uploadToGoogleDrive(g.service, data, filename)
+func (g *GoogleDriveStorage) Upload(data io.Reader, filename string) (*RemoteFile, error) {
+	return uploadToGoogleDrive(g.service, data, filename, g.folder, g.driveID)
 }
 
-// GetName returns the storage provider name
-func (g *GoogleDriveStorage) GetName() string {
-	return "Google Drive"
+// Stat returns a file by its Drive ID, or by its path under the root folder
+func (g *GoogleDriveStorage) Stat(ref FileRef) (*RemoteFile, error) {
+	if ref.ID == "" {
+		return g.statPath(ref.Path)
+	}
+
+	file, err := g.service.Files.Get(ref.ID).Fields(driveFileFields).SupportsAllDrives(true).Do()
+	if isDriveNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading Google Drive file %s: %v", ref.ID, err)
+	}
+	if file.Trashed || file.MimeType == driveFolderMimeType {
+		return nil, os.ErrNotExist
+	}
+	return driveRemoteFile(file), nil
 }
 
-// initGDriveSvc initializes the Google Drive service with OAuth 2.0 credentials
-func initGDriveSvc(credentialsFile, tokenFile string) *drive.Service {
-	if credentialsFile == "" {
-		log.Fatalf("Google credentials file not specified")
+// statPath walks down from the root folder to the file at path
+func (g *GoogleDriveStorage) statPath(path string) (*RemoteFile, error) {
+	folderID, found, err := findFolder(g.service, g.folder, g.driveID, g.driveID)
+	parts := strings.Split(path, "/")
+	for _, subfolder := range parts[:len(parts)-1] {
+		if err != nil || !found {
+			break
+		}
+		folderID, found, err = findFolder(g.service, subfolder, folderID, g.driveID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, os.ErrNotExist
 	}
 
-	credentials, err := os.ReadFile(credentialsFile)
+	query := fmt.Sprintf("name='%s' and '%s' in parents and trashed=false and mimeType!='%s'", driveQueryEscape(parts[len(parts)-1]), folderID, driveFolderMimeType)
+	listCall := g.service.Files.List().Q(query).Fields("files(" + driveFileFields + ")")
+	if g.driveID != "" {
+		listCall = listCall.Corpora("drive").DriveId(g.driveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+	}
+	files, err := listCall.Do()
 	if err != nil {
-		log.Fatalf("Error reading Google credentials file: %v", err)
+		return nil, fmt.Errorf("error searching for file %s: %v", path, err)
+	}
+	if len(files.Files) == 0 {
+		return nil, os.ErrNotExist
 	}
 
-	config, err := google.ConfigFromJSON(credentials, drive.DriveScope)
+	remote := driveRemoteFile(files.Files[0])
+	remote.Path = path
+	return remote, nil
+}
 
-	if os.Getenv("GOOGLE_REDIRECT_URL") != "" {
-		config.RedirectURL = os.Getenv("GOOGLE_REDIRECT_URL")
+// Open downloads a file by its Drive ID or path
+func (g *GoogleDriveStorage) Open(ref FileRef) (io.ReadCloser, error) {
+	id := ref.ID
+	if id == "" {
+		remote, err := g.statPath(ref.Path)
+		if err != nil {
+			return nil, err
+		}
+		id = remote.ID
 	}
 
+	resp, err := g.service.Files.Get(id).SupportsAllDrives(true).Download()
+	if isDriveNotFound(err) {
+		return nil, os.ErrNotExist
+	}
 	if err != nil {
-		log.Fatalf("Error creating OAuth config: %v", err)
+		return nil, fmt.Errorf("error downloading Google Drive file %s: %v", id, err)
 	}
+	return resp.Body, nil
+}
 
-	needFetchToken := false
-	var token *oauth2.Token
-	if _, err := os.Stat(tokenFile); os.IsNotExist(err) {
-		log.Warnf("Token file not found. Fetching new token.")
-		needFetchToken = true
-	} else {
-		token, err = tokenFromFile(tokenFile)
+// Exists reports whether a file exists by its Drive ID or path
+func (g *GoogleDriveStorage) Exists(ref FileRef) (bool, error) {
+	return statExists(g.Stat(ref))
+}
+
+// List returns one page of the files under the root folder.
+// Subfolders are queued and listed after the folder containing them.
+func (g *GoogleDriveStorage) List(pageToken string) ([]*RemoteFile, string, error) {
+	cursor, err := decodeListCursor(pageToken, listFolder{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	folder := cursor.Folders[0]
+	if folder.ID == "" {
+		folderID, found, err := findFolder(g.service, g.folder, g.driveID, g.driveID)
 		if err != nil {
-			log.Warnf("Error loading OAuth token from file: %v", err)
-			needFetchToken = true
+			return nil, "", err
+		}
+		if !found {
+			return []*RemoteFile{}, "", nil
+		}
+		folder.ID = folderID
+		cursor.Folders[0] = folder
+	}
+
+	listCall := g.service.Files.List().
+		Q(fmt.Sprintf("'%s' in parents and trashed=false", folder.ID)).
+		Fields("nextPageToken", "files("+driveFileFields+")").
+		PageSize(1000).
+		PageToken(cursor.Page)
+	if g.driveID != "" {
+		listCall = listCall.Corpora("drive").DriveId(g.driveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+	}
+	page, err := listCall.Do()
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing Google Drive folder %s: %v", folder.ID, err)
+	}
+
+	files := []*RemoteFile{}
+	for _, file := range page.Files {
+		if file.MimeType == driveFolderMimeType {
+			cursor.Folders = append(cursor.Folders, listFolder{ID: file.Id, Prefix: folder.Prefix + file.Name + "/"})
+			continue
 		}
+
+		remote := driveRemoteFile(file)
+		remote.Path = folder.Prefix + file.Name
+		files = append(files, remote)
 	}
 
-	if needFetchToken {
-		token, err = fetchInitialToken(config)
+	cursor.advance(page.NextPageToken)
+	return files, cursor.encode(), nil
+}
+
+// Delete permanently deletes a file by its Drive ID or path, bypassing the trash
+func (g *GoogleDriveStorage) Delete(ref FileRef) error {
+	id := ref.ID
+	if id == "" {
+		remote, err := g.statPath(ref.Path)
 		if err != nil {
-			log.Fatalf("Failed to fetch initial gdrive token")
+			return err
 		}
-		saveTokenToFile(token, tokenFile) // Save the new token to the file
+		id = remote.ID
 	}
 
-	client := config.Client(context.Background(), token)
-	driveService, err := drive.NewService(context.Background(), option.WithHTTPClient(client))
+	err := g.service.Files.Delete(id).SupportsAllDrives(true).Do()
+	if isDriveNotFound(err) {
+		return os.ErrNotExist
+	}
 	if err != nil {
-		log.Fatalf("Error creating Google Drive service: %v", err)
+		return fmt.Errorf("error deleting Google Drive file %s: %v", id, err)
 	}
-
-	return driveService
+	return nil
 }
 
-// fetchInitialToken starts an HTTP server to receive the OAuth authorization code and exchanges it for an OAuth token
-func fetchInitialToken(config *oauth2.Config) (*oauth2.Token, error) {
-	authCodeChannel := make(chan string)
+// Capabilities describes Google Drive. Drive allows several files with the same name in a folder.
+func (g *GoogleDriveStorage) Capabilities() StorageCapabilities {
+	return StorageCapabilities{
+		List:       true,
+		StatByID:   true,
+		StatByPath: true,
+		Delete:     true,
+		Checksums:  []string{"md5", "sha256"},
+	}
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		authCode := r.URL.Query().Get("code")
-		if authCode == "" {
-			http.Error(w, "Authorization code not found", http.StatusBadRequest)
-			return
-		}
-		authCodeChannel <- authCode
-		fmt.Fprintf(w, "Authorization successful! You can close this window.")
-	})
+// GetName returns the storage provider name
+func (g *GoogleDriveStorage) GetName() string {
+	return "Google Drive"
+}
 
-	HTTP_PORT := "8888"
-	if os.Getenv("HTTP_PORT") != "" {
-		HTTP_PORT = os.Getenv("HTTP_PORT")
+// initGDriveSvc initializes the Google Drive service from either a service account key or OAuth 2.0 client credentials
+func initGDriveSvc(config GoogleDriveConfig) *drive.Service {
+	if config.CredentialsFile == "" {
+		log.Fatalf("Google credentials file not specified")
 	}
 
-	go func() {
-		if err := http.ListenAndServe(":"+HTTP_PORT, nil); err != nil {
-			log.Fatalf("Error starting HTTP server: %v", err)
-		}
-	}()
+	credentials, err := os.ReadFile(config.CredentialsFile)
+	if err != nil {
+		log.Fatalf("Error reading Google credentials file: %v", err)
+	}
 
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
-	log.Error("Go to the following link in your browser, authorize the app, and return:")
-	log.Errorf("%s", authURL)
-	authCode := <-authCodeChannel
+	var client *http.Client
+	if isServiceAccountKey(credentials) {
+		client = serviceAccountClient(credentials, config.ImpersonateUser)
+	} else {
+		client = installedAppClient(credentials, config.TokenFile, config.AuthFlow)
+	}
 
-	token, err := config.Exchange(context.Background(), authCode)
+	driveService, err := drive.NewService(context.Background(), option.WithHTTPClient(client))
 	if err != nil {
-		return nil, fmt.Errorf("error exchanging authorization code for token: %v", err)
+		log.Fatalf("Error creating Google Drive service: %v", err)
 	}
 
-	return token, nil
+	return driveService
 }
 
-// saveTokenToFile saves an OAuth 2.0 token to a file
-func saveTokenToFile(token *oauth2.Token, tokenFile string) {
-	f, err := os.Create(tokenFile)
+// isServiceAccountKey reports whether a credentials file holds a service account key rather than OAuth client credentials
+func isServiceAccountKey(credentials []byte) bool {
+	var key struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(credentials, &key) == nil && key.Type == "service_account"
+}
+
+// serviceAccountClient authenticates as a service account, optionally impersonating a user through domain-wide delegation
+func serviceAccountClient(credentials []byte, impersonateUser string) *http.Client {
+	jwtConfig, err := google.JWTConfigFromJSON(credentials, drive.DriveScope)
 	if err != nil {
-		log.Fatalf("Error creating token file: %v", err)
+		log.Fatalf("Error reading Google service account key: %v", err)
 	}
-	defer f.Close()
 
-	if err := json.NewEncoder(f).Encode(token); err != nil {
-		log.Fatalf("Error encoding token to file: %v", err)
+	if impersonateUser != "" {
+		log.Infof("Google service account %s impersonating %s", jwtConfig.Email, impersonateUser)
+		jwtConfig.Subject = impersonateUser
+	} else {
+		log.Infof("Using Google service account %s", jwtConfig.Email)
 	}
+
+	return jwtConfig.Client(context.Background())
 }
 
-// tokenFromFile loads a previously obtained OAuth 2.0 token from a file and validates its validity
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, fmt.Errorf("error opening token file: %v", err)
+// installedAppClient authorizes as a user with the installed-app OAuth flow.
+// authFlow selects how an initial token is obtained: "browser" (default) or "device".
+func installedAppClient(credentials []byte, tokenFile, authFlow string) *http.Client {
+	// Google only allows the per-file Drive scope for the device flow
+	scope := drive.DriveScope
+	if authFlow == oauthFlowDevice {
+		scope = drive.DriveFileScope
 	}
-	defer f.Close()
 
-	token := &oauth2.Token{}
-	if err := json.NewDecoder(f).Decode(token); err != nil {
-		return nil, fmt.Errorf("error decoding token: %v", err)
+	config, err := google.ConfigFromJSON(credentials, scope)
+
+	if os.Getenv("GOOGLE_REDIRECT_URL") != "" {
+		config.RedirectURL = os.Getenv("GOOGLE_REDIRECT_URL")
 	}
 
-	// Check if the token is expired
-	if token.Expiry.Before(time.Now()) {
-		return nil, fmt.Errorf("OAuth token has expired")
+	if err != nil {
+		log.Fatalf("Error creating OAuth config: %v", err)
 	}
+	config.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
 
-	return token, nil
+	client, err := oauthClient(config, tokenFile, "Google Drive", func(config *oauth2.Config) (*oauth2.Token, error) {
+		if authFlow == oauthFlowDevice {
+			return fetchDeviceToken(config, "Google Drive")
+		}
+		return fetchBrowserToken(config, "Google Drive")
+	})
+	if err != nil {
+		log.Fatalf("Error authorizing Google Drive: %v", err)
+	}
+	return client
 }
 
-// getOrCreateFolder retrieves the ID of an existing folder by name or creates it if it doesn't exist
-func getOrCreateFolder(driveService *drive.Service, folderName string) (string, error) {
-	// Search for the folder by name
-	query := fmt.Sprintf("name='%s' and mimeType='application/vnd.google-apps.folder'", folderName)
-	files, err := driveService.Files.List().Q(query).Do()
+// driveFolderMimeType marks a Google Drive file as a folder
+const driveFolderMimeType = "application/vnd.google-apps.folder"
+
+// driveFileFields are the file fields read into a RemoteFile
+const driveFileFields googleapi.Field = "id, name, mimeType, size, md5Checksum, sha256Checksum, trashed"
+
+// findFolder looks up an existing folder by name, inside parentID when it is set
+func findFolder(driveService *drive.Service, folderName, parentID, driveID string) (string, bool, error) {
+	query := fmt.Sprintf("name='%s' and mimeType='%s'", driveQueryEscape(folderName), driveFolderMimeType)
+	if parentID != "" {
+		query += fmt.Sprintf(" and '%s' in parents and trashed=false", parentID)
+	}
+	listCall := driveService.Files.List().Q(query)
+	if driveID != "" {
+		listCall = listCall.Corpora("drive").DriveId(driveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+	}
+	files, err := listCall.Do()
 	if err != nil {
-		return "", fmt.Errorf("error searching for folder %s: %v", folderName, err)
+		return "", false, fmt.Errorf("error searching for folder %s: %v", folderName, err)
+	}
+
+	if len(files.Files) == 0 {
+		return "", false, nil
 	}
+	return files.Files[0].Id, true, nil
+}
 
-	if len(files.Files) > 0 {
-		// If the folder exists, return its ID
-		return files.Files[0].Id, nil
+// getOrCreateFolder retrieves the ID of an existing folder by name or creates it if it doesn't exist.
+// When parentID is set the folder is looked up and created inside that parent.
+// When driveID is set the lookup and creation happen inside that Shared Drive.
+func getOrCreateFolder(driveService *drive.Service, folderName, parentID, driveID string) (string, error) {
+	folderID, found, err := findFolder(driveService, folderName, parentID, driveID)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return folderID, nil
 	}
 
 	// Create the folder if it doesn't exist
 	folderMetadata := &drive.File{
 		Name:     folderName,
-		MimeType: "application/vnd.google-apps.folder",
+		MimeType: driveFolderMimeType,
 	}
-	folder, err := driveService.Files.Create(folderMetadata).Do()
+	if parentID != "" {
+		folderMetadata.Parents = []string{parentID}
+	}
+	folder, err := driveService.Files.Create(folderMetadata).SupportsAllDrives(driveID != "").Do()
 	if err != nil {
 		return "", fmt.Errorf("error creating folder %s: %v", folderName, err)
 	}
@@ -187,16 +354,27 @@ func getOrCreateFolder(driveService *drive.Service, folderName string) (string,
 	return folder.Id, nil
 }
 
-// uploadToGoogleDrive uploads the file from memory to Google Drive in a specified folder
-func uploadToGoogleDrive(driveService *drive.Service, data *bytes.Buffer, filename string) error {
-	start := time.Now()
-	folderName := "discord-export"
+// uploadToGoogleDrive streams a file to Google Drive in a specified folder.
+// A filename containing slashes is uploaded into matching subfolders, which are created as needed.
+// When driveID is set the folder lives at the root of that Shared Drive.
+func uploadToGoogleDrive(driveService *drive.Service, data io.Reader, filename, folderName, driveID string) (*RemoteFile, error) {
+	path := filename
 
-	folderID, err := getOrCreateFolder(driveService, folderName)
+	// The root of a Shared Drive has the drive's ID
+	folderID, err := getOrCreateFolder(driveService, folderName, driveID, driveID)
 	if err != nil {
-		return fmt.Errorf("error ensuring folder exists: %v", err)
+		return nil, fmt.Errorf("error ensuring folder exists: %v", err)
 	}
 
+	parts := strings.Split(filename, "/")
+	for _, subfolder := range parts[:len(parts)-1] {
+		folderID, err = getOrCreateFolder(driveService, subfolder, folderID, driveID)
+		if err != nil {
+			return nil, fmt.Errorf("error ensuring subfolder exists: %v", err)
+		}
+	}
+	filename = parts[len(parts)-1]
+
 	fileMetadata := &drive.File{
 		Name:    filename,
 		Parents: []string{folderID}, // Specify the parent folder ID
@@ -204,14 +382,39 @@ func uploadToGoogleDrive(driveService *drive.Service, data *bytes.Buffer, filena
 
 	uploadedFile, err := driveService.Files.Create(fileMetadata).
 		Media(data).
+		SupportsAllDrives(driveID != "").
+		Fields(driveFileFields).
 		Do()
 
 	if err != nil {
-		return fmt.Errorf("failed to upload %s to Google Drive: %v", filename, err)
+		return nil, fmt.Errorf("failed to upload %s to Google Drive: %v", filename, err)
 	}
 
 	log.Debugf("File uploaded to Google Drive in folder %s with ID: %s", folderName, uploadedFile.Id)
-	googleDriveUploadDuration.WithLabelValues().Observe(float64(time.Since(start).Seconds()))
 
-	return nil
+	remote := driveRemoteFile(uploadedFile)
+	remote.Path = path
+	return remote, nil
+}
+
+// isDriveNotFound reports whether a Drive API call failed because the file doesn't exist
+func isDriveNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// driveQueryEscape escapes a value for use inside a quoted Drive search query string
+func driveQueryEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+// driveRemoteFile converts a Drive file into the provider independent description
+func driveRemoteFile(file *drive.File) *RemoteFile {
+	return &RemoteFile{
+		ID:     file.Id,
+		Name:   file.Name,
+		Size:   file.Size,
+		MD5:    file.Md5Checksum,
+		SHA256: file.Sha256Checksum,
+	}
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// fakeDrivePageSize is small so listings exercise nextPageToken
+const fakeDrivePageSize = 2
+
+// fakeDrive serves the files endpoints of the Drive v3 API for a drive held in memory
+type fakeDrive struct {
+	mu     sync.Mutex
+	files  []*fakeDriveFile // in creation order
+	nextID int
+}
+
+type fakeDriveFile struct {
+	id       string
+	name     string
+	mimeType string
+	parents  []string
+	content  []byte
+}
+
+// newFakeDrive starts a fake drive and returns a provider using it, inside the Shared Drive driveID when it is set
+func newFakeDrive(t *testing.T, driveID string) *GoogleDriveStorage {
+	fake := &fakeDrive{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /files", fake.serveList)
+	mux.HandleFunc("POST /files", fake.serveCreate)
+	mux.HandleFunc("POST /upload/drive/v3/files", fake.serveCreate)
+	mux.HandleFunc("GET /files/{id}", fake.serveGet)
+	mux.HandleFunc("DELETE /files/{id}", fake.serveDelete)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &GoogleDriveStorage{service: service, folder: "discord-export", driveID: driveID}
+}
+
+// driveQueryClause matches the search query clauses the provider builds
+var driveQueryClause = regexp.MustCompile(`^(?:(name|mimeType)(!?=)'((?:[^'\\]|\\.)*)'|'([^']*)' in parents|trashed=false)$`)
+
+// serveList answers a files.list search, one page at a time
+func (f *fakeDrive) serveList(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	matches := []map[string]any{}
+	clauses := strings.Split(r.URL.Query().Get("q"), " and ")
+	for _, file := range f.files {
+		matched := true
+		for _, clause := range clauses {
+			parts := driveQueryClause.FindStringSubmatch(clause)
+			if parts == nil {
+				writeDriveError(w, http.StatusBadRequest, "unsupported query clause "+clause)
+				return
+			}
+
+			value := strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(parts[3])
+			switch {
+			case parts[1] == "name":
+				matched = matched && file.name == value
+			case parts[1] == "mimeType":
+				matched = matched && (file.mimeType == value) == (parts[2] == "=")
+			case parts[4] != "":
+				matched = matched && slices.Contains(file.parents, parts[4])
+			}
+		}
+		if matched {
+			matches = append(matches, file.json())
+		}
+	}
+
+	skip, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	end := min(skip+fakeDrivePageSize, len(matches))
+	page := map[string]any{"files": matches[min(skip, end):end]}
+	if end < len(matches) {
+		page["nextPageToken"] = strconv.Itoa(end)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// serveCreate answers files.create, both for folders and for multipart media uploads
+func (f *fakeDrive) serveCreate(w http.ResponseWriter, r *http.Request) {
+	var metadata struct {
+		Name     string   `json:"name"`
+		MimeType string   `json:"mimeType"`
+		Parents  []string `json:"parents"`
+	}
+	var content []byte
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		part, err := reader.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(&metadata)
+		}
+		if err == nil {
+			part, err = reader.NextPart()
+		}
+		if err == nil {
+			content, err = io.ReadAll(part)
+		}
+		if err != nil {
+			writeDriveError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		writeDriveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	file := &fakeDriveFile{id: fmt.Sprintf("file%d", f.nextID), name: metadata.Name, mimeType: metadata.MimeType, parents: metadata.Parents, content: content}
+	if file.mimeType == "" {
+		file.mimeType = "application/octet-stream"
+	}
+	f.files = append(f.files, file)
+	writeJSON(w, http.StatusOK, file.json())
+}
+
+// serveGet answers files.get with the file's metadata, or its content for alt=media
+func (f *fakeDrive) serveGet(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file := f.lookup(r.PathValue("id"))
+	if file == nil {
+		writeDriveError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if r.URL.Query().Get("alt") == "media" {
+		w.Write(file.content)
+		return
+	}
+	writeJSON(w, http.StatusOK, file.json())
+}
+
+// serveDelete answers files.delete
+func (f *fakeDrive) serveDelete(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file := f.lookup(r.PathValue("id"))
+	if file == nil {
+		writeDriveError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	f.files = slices.DeleteFunc(f.files, func(candidate *fakeDriveFile) bool { return candidate == file })
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeDrive) lookup(id string) *fakeDriveFile {
+	for _, file := range f.files {
+		if file.id == id {
+			return file
+		}
+	}
+	return nil
+}
+
+// writeDriveError answers with a Drive API error body
+func writeDriveError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{"error": map[string]any{"code": status, "message": message}})
+}
+
+// json renders the file as a Drive file resource
+func (file *fakeDriveFile) json() map[string]any {
+	resource := map[string]any{"id": file.id, "name": file.name, "mimeType": file.mimeType, "parents": file.parents, "trashed": false}
+	if file.mimeType != driveFolderMimeType {
+		md5Sum := md5.Sum(file.content)
+		sha256Sum := sha256.Sum256(file.content)
+		resource["size"] = strconv.Itoa(len(file.content))
+		resource["md5Checksum"] = hex.EncodeToString(md5Sum[:])
+		resource["sha256Checksum"] = hex.EncodeToString(sha256Sum[:])
+	}
+	return resource
+}
+
+func TestGoogleDriveStorageConformance(t *testing.T) {
+	for name, driveID := range map[string]string{"my drive": "", "shared drive": "shared-drive"} {
+		t.Run(name, func(t *testing.T) {
+			testStorageConformance(t, func(t *testing.T) StorageProvider {
+				return newFakeDrive(t, driveID)
+			})
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/oauth2/microsoft"
+)
+
+// graphAPI is the Microsoft Graph endpoint used for OneDrive for Business and SharePoint
+const graphAPI = "https://graph.microsoft.com/v1.0"
+
+// GraphDriveConfig holds the settings for a OneDrive for Business or SharePoint drive reached through Microsoft Graph
+type GraphDriveConfig struct {
+	ClientID     string
+	ClientSecret string
+	TenantID     string
+	TokenFile    string
+	Folder       string
+	AuthFlow     string
+
+	// DriveID targets a specific drive, such as a SharePoint document library
+	DriveID string
+	// SiteID targets the default document library of a SharePoint site
+	SiteID string
+}
+
+// NewGraphDriveStorage creates a OneDrive storage provider for Azure AD work/school tenants using Microsoft Graph.
+//
+// Required Azure App Registration settings:
+//   - Supported account types: "Accounts in this organizational directory only" (or multitenant)
+//   - Delegated permissions Files.ReadWrite.All (and Sites.ReadWrite.All for SharePoint) for the browser and device flows
+//   - Application permissions Files.ReadWrite.All or Sites.ReadWrite.All, plus a client secret, for client_credentials
+func NewGraphDriveStorage(config GraphDriveConfig) *OneDriveStorage {
+	baseURL := graphDriveURL(config.DriveID, config.SiteID)
+
+	name := "OneDrive for Business"
+	if config.SiteID != "" {
+		name = "SharePoint"
+	}
+
+	if config.AuthFlow == oauthFlowClientCredentials {
+		if config.TenantID == "" || config.ClientSecret == "" {
+			log.Fatalf("The client_credentials flow needs ONEDRIVE_TENANT_ID and ONEDRIVE_CLIENT_SECRET")
+		}
+		if config.DriveID == "" && config.SiteID == "" {
+			log.Fatalf("The client_credentials flow has no signed in user. Set ONEDRIVE_DRIVE_ID or ONEDRIVE_SITE_ID")
+		}
+
+		appConfig := &clientcredentials.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			TokenURL:     microsoft.AzureADEndpoint(config.TenantID).TokenURL,
+			Scopes:       []string{"https://graph.microsoft.com/.default"},
+		}
+		return &OneDriveStorage{
+			client:  appConfig.Client(context.Background()),
+			folder:  config.Folder,
+			baseURL: baseURL,
+			name:    name,
+		}
+	}
+
+	tenantID := config.TenantID
+	if tenantID == "" {
+		tenantID = "organizations"
+	}
+
+	scopes := []string{"https://graph.microsoft.com/Files.ReadWrite.All", "offline_access"}
+	if config.SiteID != "" || config.DriveID != "" {
+		scopes = append(scopes, "https://graph.microsoft.com/Sites.ReadWrite.All")
+	}
+
+	oauthConfig := &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		Endpoint:     microsoft.AzureADEndpoint(tenantID),
+		Scopes:       scopes,
+	}
+
+	if os.Getenv("ONEDRIVE_REDIRECT_URL") != "" {
+		oauthConfig.RedirectURL = os.Getenv("ONEDRIVE_REDIRECT_URL")
+	} else {
+		oauthConfig.RedirectURL = "http://localhost:8888/onedrive"
+	}
+
+	client, err := oauthClient(oauthConfig, config.TokenFile, name, func(oauthConfig *oauth2.Config) (*oauth2.Token, error) {
+		if config.AuthFlow == oauthFlowDevice {
+			return fetchDeviceToken(oauthConfig, name)
+		}
+		return fetchBrowserToken(oauthConfig, name)
+	})
+	if err != nil {
+		log.Fatalf("Error authorizing %s: %v", name, err)
+	}
+
+	return &OneDriveStorage{
+		client:  client,
+		config:  oauthConfig,
+		folder:  config.Folder,
+		baseURL: baseURL,
+		name:    name,
+	}
+}
+
+// graphDriveURL returns the Graph endpoint of the drive to upload into.
+// Without a drive or site the signed in user's own OneDrive is used.
+func graphDriveURL(driveID, siteID string) string {
+	switch {
+	case driveID != "":
+		return fmt.Sprintf("%s/drives/%s", graphAPI, driveID)
+	case siteID != "":
+		return fmt.Sprintf("%s/sites/%s/drive", graphAPI, siteID)
+	default:
+		return graphAPI + "/me/drive"
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// GuildTarget ties a Discord guild to the storage provider and state file its attachments are archived with
+type GuildTarget struct {
+	GuildID   string
+	Storage   StorageProvider
+	State     *StateStore
+	Retries   *RetryQueue
+	OptOuts   *OptOutRegistry
+	Router    *Router
+	Bounds    scanBounds
+	Selection *messageSelection
+	PHash     *perceptualHashSettings // nil when near-duplicate detection is off
+}
+
+// guildEnv returns the GUILD_<id>_<key> override for a guild, falling back to the global <key>
+func guildEnv(guildID, key string) string {
+	if guildID != "" {
+		if value := os.Getenv("GUILD_" + guildID + "_" + key); value != "" {
+			return value
+		}
+	}
+	return os.Getenv(key)
+}
+
+// getGuildIds resolves DISCORD_GUILD_ID into a list of guilds.
+// A comma separated list archives each listed guild, while "*" archives every guild the bot is a member of.
+func getGuildIds(dg *discordgo.Session, configured string) []string {
+	configured = strings.TrimSpace(configured)
+	if configured == "*" {
+		return discoverGuildIds(dg)
+	}
+
+	guildIds := []string{}
+	for _, guildId := range strings.Split(configured, ",") {
+		guildId = strings.TrimSpace(guildId)
+		if guildId != "" {
+			guildIds = append(guildIds, guildId)
+		}
+	}
+
+	if len(guildIds) == 0 {
+		log.Fatalf("No guilds configured. Set DISCORD_GUILD_ID to a guild ID, a comma separated list of IDs, or *")
+	}
+	return guildIds
+}
+
+// discoverGuildIds pages through every guild the bot user has joined
+func discoverGuildIds(dg *discordgo.Session) []string {
+	guildIds := []string{}
+	afterId := ""
+
+	for {
+		guilds, err := dg.UserGuilds(200, "", afterId, false)
+		if err != nil {
+			log.Fatalf("Error discovering guilds: %v", err)
+		}
+		if len(guilds) == 0 {
+			break
+		}
+
+		for _, guild := range guilds {
+			log.Debugf("Discovered guild %s %s", guild.Name, guild.ID)
+			guildIds = append(guildIds, guild.ID)
+		}
+		afterId = guilds[len(guilds)-1].ID
+	}
+
+	log.Infof("Discovered %d guilds", len(guildIds))
+	return guildIds
+}
+
+// initGuildTargets builds a GuildTarget for every configured guild.
+// Guilds resolving to the same storage configuration or state file share a single instance of each.
+func initGuildTargets(dg *discordgo.Session, router *Router) []*GuildTarget {
+	providers := map[string]StorageProvider{}
+	states := map[string]*StateStore{}
+	retryQueues := map[string]*RetryQueue{}
+	optOutRegistries := map[string]*OptOutRegistry{}
+	targets := []*GuildTarget{}
+
+	for _, guildId := range getGuildIds(dg, os.Getenv("DISCORD_GUILD_ID")) {
+		env := func(key string) string { return guildEnv(guildId, key) }
+		storageKey := storageConfigKey(env)
+		storage, ok := providers[storageKey]
+		if !ok {
+			storage = initStorage(env, router.destinations)
+			providers[storageKey] = storage
+
+			// Destination names can't contain a colon, so guild storage names never clash with them
+			router.names[storage] = "guild:default"
+			if storageKey != storageConfigKey(os.Getenv) {
+				router.names[storage] = "guild:" + guildId
+			}
+		}
+
+		statePath := guildEnv(guildId, "STATE_FILE")
+		state, ok := states[statePath]
+		if !ok {
+			state = openStateStore(statePath)
+			states[statePath] = state
+		}
+
+		retryPath := retryQueuePath(guildId)
+		retries, ok := retryQueues[retryPath]
+		if !ok {
+			retries = openRetryQueue(retryPath)
+			retryQueues[retryPath] = retries
+		}
+
+		optOutFile := optOutPath(guildId)
+		optOuts, ok := optOutRegistries[optOutFile]
+		if !ok {
+			optOuts = openOptOutRegistry(optOutFile)
+			optOutRegistries[optOutFile] = optOuts
+		}
+
+		bounds, err := parseScanBounds(guildId)
+		if err != nil {
+			log.Fatalf("Error reading scan bounds for guild %s: %v", guildId, err)
+		}
+
+		selection, err := parseMessageSelection(guildId)
+		if err != nil {
+			log.Fatalf("Error reading message selection for guild %s: %v", guildId, err)
+		}
+
+		phash, err := parsePerceptualHashSettings(guildId)
+		if err != nil {
+			log.Fatalf("Error reading perceptual hash settings for guild %s: %v", guildId, err)
+		}
+
+		log.Infof("Guild %s archives to %s (%s)", guildId, router.destinationName(storage), storage.GetName())
+		targets = append(targets, &GuildTarget{
+			GuildID:   guildId,
+			Storage:   storage,
+			State:     state,
+			Retries:   retries,
+			OptOuts:   optOuts,
+			Router:    router,
+			Bounds:    bounds,
+			Selection: selection,
+			PHash:     phash,
+		})
+	}
+
+	return targets
+}
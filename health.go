@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// readinessProbePath is looked up in every storage provider to check that it is reachable and authenticated
+const readinessProbePath = ".discord-photo-reaper-readiness"
+
+// storageProbeTTL is how long a storage readiness check is reused, so probes don't hammer the provider's API
+const storageProbeTTL = time.Minute
+
+// readinessCheck is the result of one readiness check
+type readinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// storageProbe is a cached storage readiness check
+type storageProbe struct {
+	err     error
+	checked time.Time
+}
+
+var (
+	storageProbesMu sync.Mutex
+	storageProbes   = map[StorageProvider]*storageProbe{}
+)
+
+// writeJSON writes value as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Debugf("Error writing JSON response: %v", err)
+	}
+}
+
+// healthzHandler reports the process as alive. The gateway state is included for information only:
+// discordgo reconnects on its own, and restarting the pod wouldn't bring the gateway back any sooner.
+func healthzHandler(dg *discordgo.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dg.RLock()
+		connected := dg.DataReady
+		dg.RUnlock()
+
+		writeJSON(w, http.StatusOK, map[string]bool{"alive": true, "gateway_connected": connected})
+	}
+}
+
+// readyzHandler reports the process as ready once every guild target's storage is reachable and authenticated
+// and its state store is open
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	activeTargets.Lock()
+	targets := activeTargets.targets
+	activeTargets.Unlock()
+
+	checks := []readinessCheck{}
+	if len(targets) == 0 {
+		checks = append(checks, readinessCheck{Name: "targets", Error: "guild targets haven't been initialised yet"})
+	}
+
+	for name, storage := range storagesByName(targets) {
+		check := readinessCheck{Name: "storage " + name, OK: true}
+		if err := probeStorage(storage); err != nil {
+			check.OK, check.Error = false, err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	seenStates := map[*StateStore]bool{}
+	for _, target := range targets {
+		if seenStates[target.State] {
+			continue
+		}
+		seenStates[target.State] = true
+
+		check := readinessCheck{Name: "state " + target.State.path, OK: true}
+		if err := checkStateStore(target.State); err != nil {
+			check.OK, check.Error = false, err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, map[string]any{"ready": status == http.StatusOK, "checks": checks})
+}
+
+// probeStorage looks up a file that doesn't exist, which fails when the provider is unreachable or its credentials are invalid.
+// Results are reused for storageProbeTTL.
+func probeStorage(storage StorageProvider) error {
+	storageProbesMu.Lock()
+	defer storageProbesMu.Unlock()
+
+	if probe, ok := storageProbes[storage]; ok && time.Since(probe.checked) < storageProbeTTL {
+		return probe.err
+	}
+
+	_, err := storage.Exists(FileRef{Path: readinessProbePath})
+	storageProbes[storage] = &storageProbe{err: err, checked: time.Now()}
+	return err
+}
+
+// checkStateStore checks that a state store's file can be read, or created in its directory before the first record
+func checkStateStore(state *StateStore) error {
+	if _, err := os.Stat(state.path); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	_, err := os.Stat(filepath.Dir(state.path))
+	return err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LocalStorage implements StorageProvider for a directory on local disk, such as a mounted NAS share
+type LocalStorage struct {
+	folder string
+}
+
+// NewLocalStorage creates a new local disk storage provider rooted at folder
+func NewLocalStorage(folder string) *LocalStorage {
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		log.Fatalf("Error creating local storage folder %s: %v", folder, err)
+	}
+	return &LocalStorage{folder: folder}
+}
+
+// Upload writes a file into the local storage folder.
+// A filename containing slashes is written into matching subfolders, which are created as needed.
+// Existing files are never overwritten: a name already taken gets a numbered suffix, which the returned path carries.
+func (l *LocalStorage) Upload(data io.Reader, filename string) (*RemoteFile, error) {
+	path := l.path(FileRef{Path: filename})
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create folder for %s in local storage: %v", filename, err)
+	}
+
+	file, path, err := createUnique(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s in local storage: %v", filename, err)
+	}
+	_, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write %s to local storage: %v", filename, err)
+	}
+
+	log.Debugf("File written to local storage at %s", path)
+	return localRemoteFile(l.folder, path)
+}
+
+// createUnique creates a new file at path, or at "name (n).ext" while that name is taken,
+// so attachments sharing a name such as image.png don't overwrite each other
+func createUnique(path string) (*os.File, string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	candidate := path
+	for n := 1; ; n++ {
+		file, err := os.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return file, candidate, nil
+		}
+		if !os.IsExist(err) {
+			return nil, "", err
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+}
+
+// localRemoteFile reads a file back from disk to describe what was actually stored
+func localRemoteFile(folder, path string) (*RemoteFile, error) {
+	written, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read back %s from local storage: %v", path, err)
+	}
+
+	sum := sha256.Sum256(written)
+	relative, _ := filepath.Rel(folder, path)
+	return &RemoteFile{
+		ID:     filepath.ToSlash(relative),
+		Name:   filepath.Base(path),
+		Path:   filepath.ToSlash(relative),
+		Size:   int64(len(written)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// localListPageSize is the number of files checksummed per page of a listing
+const localListPageSize = 1000
+
+// Stat returns a file by its path under the storage folder. IDs are the same as paths.
+func (l *LocalStorage) Stat(ref FileRef) (*RemoteFile, error) {
+	path := l.path(ref)
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("failed to stat %s in local storage: %v", path, err)
+	}
+	if info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	return localRemoteFile(l.folder, path)
+}
+
+// Open opens a file under the storage folder
+func (l *LocalStorage) Open(ref FileRef) (io.ReadCloser, error) {
+	file, err := os.Open(l.path(ref))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("failed to open %s in local storage: %v", ref.Path, err)
+	}
+	return file, nil
+}
+
+// Exists reports whether a file exists under the storage folder
+func (l *LocalStorage) Exists(ref FileRef) (bool, error) {
+	return statExists(l.Stat(ref))
+}
+
+// List returns one page of the files under the storage folder, reading each one to checksum it.
+// The page token is the number of files already listed.
+func (l *LocalStorage) List(pageToken string) ([]*RemoteFile, string, error) {
+	offset := 0
+	if pageToken != "" {
+		var err error
+		if offset, err = strconv.Atoi(pageToken); err != nil {
+			return nil, "", fmt.Errorf("invalid page token: %v", err)
+		}
+	}
+
+	paths := []string{}
+	err := filepath.WalkDir(l.folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == l.folder {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list local storage: %v", err)
+	}
+
+	end := min(offset+localListPageSize, len(paths))
+	files := []*RemoteFile{}
+	for _, path := range paths[min(offset, end):end] {
+		remote, err := localRemoteFile(l.folder, path)
+		if err != nil {
+			return nil, "", err
+		}
+		files = append(files, remote)
+	}
+
+	if end == len(paths) {
+		return files, "", nil
+	}
+	return files, strconv.Itoa(end), nil
+}
+
+// Delete removes a file from the storage folder
+func (l *LocalStorage) Delete(ref FileRef) error {
+	if err := os.Remove(l.path(ref)); err != nil {
+		if os.IsNotExist(err) {
+			return os.ErrNotExist
+		}
+		return fmt.Errorf("failed to delete %s from local storage: %v", ref.Path, err)
+	}
+	return nil
+}
+
+// Capabilities describes local storage
+func (l *LocalStorage) Capabilities() StorageCapabilities {
+	return StorageCapabilities{
+		List:       true,
+		StatByID:   true,
+		StatByPath: true,
+		Delete:     true,
+		Checksums:  []string{"sha256"},
+	}
+}
+
+// path returns where ref lives on disk, never outside the storage folder
+func (l *LocalStorage) path(ref FileRef) string {
+	relative := ref.Path
+	if ref.ID != "" {
+		relative = ref.ID
+	}
+	return filepath.Join(l.folder, filepath.Clean("/"+relative))
+}
+
+// GetName returns the storage provider name
+func (l *LocalStorage) GetName() string {
+	return "Local"
+}
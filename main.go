@@ -3,94 +3,185 @@ package main
 import (
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	log "github.com/sirupsen/logrus"
 )
 
-func initStorage() StorageProvider {
-	storageType := os.Getenv("STORAGE_PROVIDER")
+// storageEnvKeys lists every environment variable that shapes a storage provider
+var storageEnvKeys = []string{
+	"STORAGE_PROVIDER",
+	"STORAGE_ROOT_FOLDER",
+	"GOOGLE_CREDENTIALS_FILE",
+	"GOOGLE_TOKEN_FILE",
+	"ONEDRIVE_CLIENT_ID",
+	"ONEDRIVE_CLIENT_SECRET",
+	"ONEDRIVE_TOKEN_FILE",
+	"STORAGE_TARGETS",
+	"STORAGE_MIN_SUCCESS",
+	"OAUTH_FLOW",
+	"GOOGLE_IMPERSONATE_USER",
+	"GOOGLE_SHARED_DRIVE_ID",
+	"ONEDRIVE_MODE",
+	"ONEDRIVE_TENANT_ID",
+	"ONEDRIVE_DRIVE_ID",
+	"ONEDRIVE_SITE_ID",
+}
+
+// storageConfigKey identifies the storage configuration resolved by an env lookup
+func storageConfigKey(env func(string) string) string {
+	values := []string{}
+	for _, key := range storageEnvKeys {
+		values = append(values, env(key))
+	}
+	return strings.Join(values, "\x00")
+}
+
+// initStorage builds a storage provider from the settings returned by env.
+// Fan-out providers look their targets up in registry.
+func initStorage(env func(string) string, registry map[string]StorageProvider) StorageProvider {
+	storageType := env("STORAGE_PROVIDER")
 	if storageType == "" {
 		storageType = "gdrive" // Default to Google Drive for backwards compatibility
 	}
 
+	rootFolder := env("STORAGE_ROOT_FOLDER")
+	if rootFolder == "" {
+		rootFolder = "discord-export"
+	}
+
+	authFlow := env("OAUTH_FLOW")
+	if authFlow == "" {
+		authFlow = oauthFlowBrowser
+	}
+	if authFlow != oauthFlowBrowser && authFlow != oauthFlowDevice && authFlow != oauthFlowClientCredentials {
+		log.Fatalf("Unknown OAUTH_FLOW: %s. Valid options are 'browser', 'device' or 'client_credentials'", authFlow)
+	}
+
 	switch storageType {
 	case "onedrive":
 		log.Info("Initializing OneDrive storage")
-		clientID := os.Getenv("ONEDRIVE_CLIENT_ID")
-		clientSecret := os.Getenv("ONEDRIVE_CLIENT_SECRET") // Not used for personal accounts, kept for API compatibility
-		tokenFile := os.Getenv("ONEDRIVE_TOKEN_FILE")
+		clientID := env("ONEDRIVE_CLIENT_ID")
+		clientSecret := env("ONEDRIVE_CLIENT_SECRET") // Only used by Graph mode; personal accounts are public clients
+		tokenFile := env("ONEDRIVE_TOKEN_FILE")
 		if tokenFile == "" {
 			tokenFile = "onedrive_token.json"
 		}
 		if clientID == "" {
 			log.Fatalf("OneDrive credentials not configured. Set ONEDRIVE_CLIENT_ID")
 		}
-		return NewOneDriveStorage(clientID, clientSecret, tokenFile)
+		if env("ONEDRIVE_MODE") == "graph" {
+			return NewGraphDriveStorage(GraphDriveConfig{
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				TenantID:     env("ONEDRIVE_TENANT_ID"),
+				TokenFile:    tokenFile,
+				Folder:       rootFolder,
+				AuthFlow:     authFlow,
+				DriveID:      env("ONEDRIVE_DRIVE_ID"),
+				SiteID:       env("ONEDRIVE_SITE_ID"),
+			})
+		}
+		if authFlow == oauthFlowClientCredentials {
+			log.Fatalf("The client_credentials flow is only supported with ONEDRIVE_MODE=graph")
+		}
+		return NewOneDriveStorage(clientID, clientSecret, tokenFile, rootFolder, authFlow)
 	case "gdrive":
 		log.Info("Initializing Google Drive storage")
-		credentialsFile := os.Getenv("GOOGLE_CREDENTIALS_FILE")
-		tokenFile := os.Getenv("GOOGLE_TOKEN_FILE")
+		credentialsFile := env("GOOGLE_CREDENTIALS_FILE")
+		tokenFile := env("GOOGLE_TOKEN_FILE")
 		if credentialsFile == "" {
 			log.Fatalf("Google credentials file not specified")
 		}
 		if tokenFile == "" {
 			tokenFile = "client_token.json"
 		}
-		return NewGoogleDriveStorage(credentialsFile, tokenFile)
+		if authFlow == oauthFlowClientCredentials {
+			log.Fatalf("The client_credentials flow is not supported for Google Drive, use a service account key instead")
+		}
+		return NewGoogleDriveStorage(GoogleDriveConfig{
+			CredentialsFile: credentialsFile,
+			TokenFile:       tokenFile,
+			Folder:          rootFolder,
+			AuthFlow:        authFlow,
+			ImpersonateUser: env("GOOGLE_IMPERSONATE_USER"),
+			SharedDriveID:   env("GOOGLE_SHARED_DRIVE_ID"),
+		})
+	case "local":
+		log.Info("Initializing local storage")
+		return NewLocalStorage(rootFolder)
+	case "fanout":
+		log.Info("Initializing fan-out storage")
+		return newFanOutStorageFromEnv(env, registry)
 	default:
-		log.Fatalf("Unknown storage provider: %s. Valid options are 'gdrive' or 'onedrive'", storageType)
+		log.Fatalf("Unknown storage provider: %s. Valid options are 'gdrive', 'onedrive', 'local' or 'fanout'", storageType)
 		return nil
 	}
 }
 
 func main() {
-	if os.Getenv("DAEMON") == "1" {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
+	dg := connect()
+	defer dg.Close()
+
+	daemonMode = os.Getenv("DAEMON") == "1"
+	initMetrics(dg)
+	log.Info("Metrics init'd")
+
+	if os.Getenv("SLASH_COMMANDS") == "1" {
+		registerSlashCommands(dg)
+	}
+
+	if daemonMode {
 		seconds, err := strconv.ParseInt(os.Getenv("DAEMON_SLEEP_SECONDS"), 10, 0)
 		if err != nil {
 			log.Fatalf("Invalid DAEMON_SLEEP_SECONDS: %v", err)
 		}
-		run()
+		run(dg)
 
 		ticker := time.NewTicker(time.Duration(seconds) * time.Second)
 		defer ticker.Stop()
 		go func() {
-			for range ticker.C {
-				log.Debugf("Woke up after %v seconds", os.Getenv("DAEMON_SLEEP_SECS"))
-				run()
+			for {
+				select {
+				case <-ticker.C:
+					log.Debugf("Woke up after %v seconds", os.Getenv("DAEMON_SLEEP_SECS"))
+				case <-runRequests:
+					log.Infof("Starting a run requested through the admin API")
+				}
+				waitWhilePaused()
+				run(dg)
 			}
 		}()
 
 		select {}
 	} else {
-		run()
+		run(dg)
 	}
 }
 
-func run() {
-	setupLogs()
-
-	token := os.Getenv("DISCORD_BOT_TOKEN")
-
-	dg := initDiscordGo(token)
-	log.Info("Discord init'ed")
-
-	storage := initStorage()
-	log.Infof("%s storage init'ed", storage.GetName())
+// runMu keeps scheduled runs and on-demand scans from archiving at the same time
+var runMu sync.Mutex
 
-	processedFilePath = os.Getenv("STATE_FILE")
-	urlFile := initProcessedEntities()
-	log.Info("State file init'ed")
+func run(dg *discordgo.Session) {
+	runMu.Lock()
+	defer runMu.Unlock()
 
-	initMetrics()
-	log.Info("Metrics init'd")
+	targets := initTargets(dg)
+	setActiveTargets(targets)
 
 	if os.Getenv("RUN_E2E") == "1" {
 		log.Warn("Running E2E")
 		validateCanDownloadFile(
 			dg,
-			storage,
+			targets[0],
 			os.Getenv("E2E_CHANNEL_ID"),
 			os.Getenv("E2E_MESSAGE_ID"),
 		)
@@ -98,21 +189,80 @@ func run() {
 		os.Exit(0)
 	}
 
-	channel_ids := getChannelIds(dg, os.Getenv("DISCORD_GUILD_ID"))
+	for _, target := range targets {
+		startRunStatus(target.GuildID)
+		retryFailedJobs(dg, target)
 
-	for _, channel_id := range channel_ids {
-		scanChannel(dg, channel_id, storage)
-	}
+		channels := getChannels(dg, target.GuildID)
 
-	log.Infof("All files downloaded.")
+		for _, channel := range channels {
+			waitWhilePaused()
+			scanChannel(dg, channel, target)
+		}
+
+		log.Infof("All files downloaded for guild %s.", target.GuildID)
+		lastRunSuccess.WithLabelValues(target.GuildID).Set(1)
+		lastSuccessTime.WithLabelValues(target.GuildID).SetToCurrentTime()
+		finishRunStatus(target.GuildID)
+		sendRunReport(dg, target.GuildID)
+	}
 
-	defer dg.Close()
-	defer urlFile.Close()
-	lastRunSuccess.WithLabelValues().Set(1)
 	log.Infof("The application completed successfully.")
 }
 
-func validateCanDownloadFile(dg *discordgo.Session, storage StorageProvider, channelID string, messageID string) error {
+// queueChannelScan scans one channel outside the schedule, once any run in progress has finished.
+// done is called when the scan completes.
+func queueChannelScan(dg *discordgo.Session, target *GuildTarget, channel *discordgo.Channel, done func()) {
+	go func() {
+		runMu.Lock()
+		defer runMu.Unlock()
+
+		// A run may have rebuilt the targets while the scan waited
+		if current := activeTarget(target.GuildID); current != nil {
+			target = current
+		}
+		scanChannel(dg, channel, target)
+		done()
+	}()
+}
+
+// setup connects to Discord and builds every guild target with its storage and state
+func setup() (*discordgo.Session, []*GuildTarget) {
+	dg := connect()
+	return dg, initTargets(dg)
+}
+
+// connect sets up logging and opens the Discord session, which stays open for the life of the process
+func connect() *discordgo.Session {
+	setupLogs()
+
+	token := os.Getenv("DISCORD_BOT_TOKEN")
+
+	dg := initDiscordGo(token)
+	log.Info("Discord init'ed")
+
+	initTokenStore()
+	return dg
+}
+
+// initTargets builds every guild target with its storage and state.
+// Runs build them afresh, so changes made by maintenance commands in between are picked up.
+func initTargets(dg *discordgo.Session) []*GuildTarget {
+	router := initRouter(initStorageRegistry())
+	log.Info("Storage routing init'ed")
+
+	targets := initGuildTargets(dg, router)
+	log.Infof("%d guild targets init'ed", len(targets))
+
+	return targets
+}
+
+func validateCanDownloadFile(dg *discordgo.Session, target *GuildTarget, channelID string, messageID string) error {
+	channel, err := dg.Channel(channelID)
+	if err != nil {
+		log.Fatalf("error fetching channel with ID %s: %v", channelID, err)
+	}
+
 	msgs, err := dg.ChannelMessages(channelID, 1, "", "", messageID)
 	if err != nil {
 		log.Fatalf("error fetching message with ID %s: %v", messageID, err)
@@ -128,7 +278,7 @@ func validateCanDownloadFile(dg *discordgo.Session, storage StorageProvider, cha
 	var messages []*discordgo.Message
 	messages = append(messages, msg)
 	log.Debugf("Scanning....")
-	scanMessages(storage, messages)
+	scanMessages(dg, target, channel, messages)
 	log.Debugf("Scan completed")
 	return nil
 }
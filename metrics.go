@@ -4,18 +4,46 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	googleDriveUploadDuration = prometheus.NewHistogramVec(
+	uploadDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name: "dpr_google_drive_upload_duration",
-			Help: "Histogram of the duration of Google Drive Upload Requests.",
+			Name:    "dpr_upload_duration_seconds",
+			Help:    "Histogram of the duration of uploads to a storage provider, by provider and result",
+			Buckets: transferBuckets,
 		},
-		[]string{},
+		[]string{"provider", "result"},
+	)
+
+	uploadBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_upload_bytes",
+			Help: "# of bytes uploaded to a storage provider",
+		},
+		[]string{"provider"},
+	)
+
+	downloadDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dpr_download_duration_seconds",
+			Help:    "Histogram of the duration of completed downloads, from Discord or from a storage provider",
+			Buckets: transferBuckets,
+		},
+		[]string{"provider"},
+	)
+
+	downloadBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_download_bytes",
+			Help: "# of bytes downloaded, from Discord or from a storage provider",
+		},
+		[]string{"provider"},
 	)
 
 	batchProcessingTime = prometheus.NewHistogramVec(
@@ -23,21 +51,119 @@ var (
 			Name: "dpr_batch_processing_time",
 			Help: "Histogram of the duration of Discord Message Batch Processing.",
 		},
-		[]string{},
+		[]string{"guild"},
 	)
 
-	messagesChecked = prometheus.NewCounter(
+	messagesChecked = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "dpr_messages_checked",
 			Help: "# of messages scanned",
 		},
+		[]string{"guild", "channel"},
+	)
+
+	messagesSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_messages_skipped",
+			Help: "# of messages with attachments left out by the message selection, by the setting that excluded them",
+		},
+		[]string{"guild", "reason"},
+	)
+
+	files = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_files",
+			Help: "# of attachments handled, by channel and outcome: uploaded, skipped_dedupe, filtered or failed",
+		},
+		[]string{"guild", "channel", "outcome"},
+	)
+
+	dedupeHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_dedupe_hits",
+			Help: "# of attachments identical to an already archived file",
+		},
+		[]string{"guild", "mode"},
+	)
+
+	nearDuplicateHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_near_duplicate_hits",
+			Help: "# of images perceptually similar to an already archived image",
+		},
+		[]string{"guild", "mode"},
+	)
+
+	uploadVerificationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_upload_verification_failures",
+			Help: "# of uploads whose stored size or checksum didn't match the downloaded file",
+		},
+		[]string{"provider"},
 	)
 
-	uploadedFiles = prometheus.NewCounter(
+	downloadSizeMismatches = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "dpr_uploaded_files",
-			Help: "# of uploaded files",
+			Name: "dpr_download_size_mismatches",
+			Help: "# of downloads whose byte count didn't match the attachment size reported by Discord",
 		},
+		[]string{"guild"},
+	)
+
+	cdnURLRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_cdn_url_refreshes",
+			Help: "# of expired Discord attachment URLs refreshed, by method and result",
+		},
+		[]string{"guild", "method", "result"},
+	)
+
+	discordRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_discord_requests",
+			Help: "# of Discord REST requests sent, by route and status code",
+		},
+		[]string{"route", "status"},
+	)
+
+	discordRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_discord_retries",
+			Help: "# of Discord REST requests retried, by route and reason",
+		},
+		[]string{"route", "reason"},
+	)
+
+	discordRateLimitWaits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_discord_rate_limit_waits",
+			Help: "# of times a Discord REST request waited for a rate limit, by route and scope",
+		},
+		[]string{"route", "scope"},
+	)
+
+	discordRateLimitWaitSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_discord_rate_limit_wait_seconds",
+			Help: "Total seconds spent waiting for Discord rate limits, by route",
+		},
+		[]string{"route"},
+	)
+
+	oauthTokenRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dpr_oauth_token_refreshes",
+			Help: "# of OAuth token refresh attempts by result",
+		},
+		[]string{"provider", "result"},
+	)
+
+	oauthTokenRefreshedTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dpr_oauth_token_refreshed_timestamp_seconds",
+			Help: "Unix time the OAuth access token was last obtained or refreshed",
+		},
+		[]string{"provider"},
 	)
 
 	lastRunSuccess = prometheus.NewGaugeVec(
@@ -45,29 +171,122 @@ var (
 			Name: "dpr_success",
 			Help: "The application records a 1 on successful exit",
 		},
-		[]string{},
+		[]string{"guild"},
+	)
+
+	lastSuccessTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dpr_last_success_timestamp_seconds",
+			Help: "Unix time the last run over a guild completed",
+		},
+		[]string{"guild"},
+	)
+
+	retryQueueDepthDesc = prometheus.NewDesc(
+		"dpr_retry_queue_depth",
+		"# of failed attachments in the retry queue, by state: pending or dead",
+		[]string{"guild", "state"}, nil,
+	)
+
+	transfersInFlightDesc = prometheus.NewDesc(
+		"dpr_transfers_in_flight",
+		"# of attachments being downloaded and archived right now",
+		[]string{"guild"}, nil,
 	)
 )
 
-func initMetrics() {
-	METRICS_HTTP_PORT := "8889"
-	if os.Getenv("METRICS_HTTP_PORT") != "" {
-		METRICS_HTTP_PORT = os.Getenv("METRICS_HTTP_PORT")
+// transferBuckets spread from a small image on a fast link to a large video on a slow one
+var transferBuckets = prometheus.ExponentialBuckets(0.05, 2, 12)
+
+// Outcomes of an attachment, the outcome label of dpr_files
+const (
+	fileUploaded      = "uploaded"
+	fileSkippedDedupe = "skipped_dedupe"
+	fileFiltered      = "filtered"
+	fileFailed        = "failed"
+)
+
+// countFile counts an attachment of a channel under its outcome
+func countFile(guildID, channelID, outcome string) {
+	files.WithLabelValues(guildID, channelID, outcome).Inc()
+}
+
+// queueCollector reports the depth of the retry queues and the transfers in flight of the active guild targets
+// when metrics are scraped, so they never drift from the queues themselves
+type queueCollector struct{}
+
+// Describe sends the descriptors of the queue metrics
+func (queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- retryQueueDepthDesc
+	ch <- transfersInFlightDesc
+}
+
+// Collect reads the retry queues and transfers in flight
+func (queueCollector) Collect(ch chan<- prometheus.Metric) {
+	activeTargets.Lock()
+	targets := activeTargets.targets
+	activeTargets.Unlock()
+
+	inFlightByGuild := map[string]int{}
+	for _, t := range inFlightTransfers() {
+		inFlightByGuild[t.GuildID]++
+	}
+
+	for _, target := range targets {
+		pending := len(target.Retries.list(target.GuildID, false))
+		dead := len(target.Retries.list(target.GuildID, true))
+		ch <- prometheus.MustNewConstMetric(retryQueueDepthDesc, prometheus.GaugeValue, float64(pending), target.GuildID, "pending")
+		ch <- prometheus.MustNewConstMetric(retryQueueDepthDesc, prometheus.GaugeValue, float64(dead), target.GuildID, "dead")
+		ch <- prometheus.MustNewConstMetric(transfersInFlightDesc, prometheus.GaugeValue, float64(inFlightByGuild[target.GuildID]), target.GuildID)
 	}
+}
+
+// metricsOnce registers the metrics and starts the HTTP server only once, however many runs the daemon makes
+var metricsOnce sync.Once
 
-	prometheus.MustRegister(googleDriveUploadDuration)
-	prometheus.MustRegister(batchProcessingTime)
-	prometheus.MustRegister(messagesChecked)
-	prometheus.MustRegister(lastRunSuccess)
-	prometheus.MustRegister(uploadedFiles)
-
-	// Expose Prometheus metrics endpoint
-	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		err := http.ListenAndServe(":"+METRICS_HTTP_PORT, nil)
-		if err != nil {
-			log.Fatal("Failed to start Prometheus metrics server: ", err)
+// initMetrics registers the metrics and serves them along with the health checks and the admin API
+func initMetrics(dg *discordgo.Session) {
+	metricsOnce.Do(func() {
+		METRICS_HTTP_PORT := "8889"
+		if os.Getenv("METRICS_HTTP_PORT") != "" {
+			METRICS_HTTP_PORT = os.Getenv("METRICS_HTTP_PORT")
 		}
-	}()
 
+		prometheus.MustRegister(uploadDuration)
+		prometheus.MustRegister(uploadBytes)
+		prometheus.MustRegister(downloadDuration)
+		prometheus.MustRegister(downloadBytes)
+		prometheus.MustRegister(batchProcessingTime)
+		prometheus.MustRegister(messagesChecked)
+		prometheus.MustRegister(messagesSkipped)
+		prometheus.MustRegister(files)
+		prometheus.MustRegister(lastRunSuccess)
+		prometheus.MustRegister(lastSuccessTime)
+		prometheus.MustRegister(queueCollector{})
+		prometheus.MustRegister(dedupeHits)
+		prometheus.MustRegister(nearDuplicateHits)
+		prometheus.MustRegister(uploadVerificationFailures)
+		prometheus.MustRegister(downloadSizeMismatches)
+		prometheus.MustRegister(cdnURLRefreshes)
+		prometheus.MustRegister(discordRequests)
+		prometheus.MustRegister(discordRetries)
+		prometheus.MustRegister(discordRateLimitWaits)
+		prometheus.MustRegister(discordRateLimitWaitSeconds)
+		prometheus.MustRegister(oauthTokenRefreshes)
+		prometheus.MustRegister(oauthTokenRefreshedTime)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/healthz", healthzHandler(dg))
+		mux.HandleFunc("/readyz", readyzHandler)
+		registerAdminAPI(mux, dg)
+
+		// Expose Prometheus metrics endpoint
+		go func() {
+			err := http.ListenAndServe(":"+METRICS_HTTP_PORT, mux)
+			if err != nil {
+				log.Fatal("Failed to start Prometheus metrics server: ", err)
+			}
+		}()
+	})
 }
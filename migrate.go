@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migrateCommand copies every archived file from one storage destination to another without going back to Discord.
+// Files keep their paths, and their state records are rewritten to point at the new copy.
+// Progress is kept in a file next to the state file, so an interrupted migration picks up where it stopped.
+func migrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromName := flags.String("from", "", "storage destination to copy files from")
+	toName := flags.String("to", "", "storage destination to copy files to")
+	rate := flags.Float64("rate", 2, "files copied per second, 0 for no limit")
+	flags.Parse(args)
+
+	dg, targets := setup()
+	defer dg.Close()
+
+	destinations := targets[0].Router.destinations
+	from, ok := destinations[*fromName]
+	if !ok {
+		log.Fatalf("Unknown storage destination to migrate from: %q. Set -from to a name in STORAGE_DESTINATIONS", *fromName)
+	}
+	to, ok := destinations[*toName]
+	if !ok {
+		log.Fatalf("Unknown storage destination to migrate to: %q. Set -to to a name in STORAGE_DESTINATIONS", *toName)
+	}
+	if from == to {
+		log.Fatalf("Can't migrate %s to itself", *fromName)
+	}
+
+	var throttle <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	copied, skipped, failed := 0, 0, 0
+	seenStates := map[*StateStore]bool{}
+	for _, target := range targets {
+		state := target.State
+		if seenStates[state] {
+			continue
+		}
+		seenStates[state] = true
+		progress := openStateStore(state.path + ".migrate")
+
+		records := state.records()
+		sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+		for _, record := range records {
+			if record.Type != recordTypeFile || record.Destination != *fromName {
+				continue
+			}
+
+			done := *toName + " " + record.Entity
+			if progress.checkOk(done) {
+				skipped++
+				continue
+			}
+
+			if throttle != nil {
+				<-throttle
+			}
+			if err := migrateRecord(from, to, *toName, state, record); err != nil {
+				log.Errorf("Error migrating %s (%s): %v", recordPath(record), record.Entity, err)
+				failed++
+				continue
+			}
+			progress.recordOk(done)
+			copied++
+		}
+
+		// Duplicates only reference an earlier upload, so they follow it once it has moved
+		for _, record := range records {
+			if record.Type != recordTypeDuplicate || record.Destination != *fromName {
+				continue
+			}
+			if original, ok := state.lookupFile(record.DuplicateOf); ok && original.Destination == *toName {
+				moved := *record
+				moved.Destination = *toName
+				state.recordFile(&moved)
+			}
+		}
+	}
+
+	log.Infof("Migrated %s to %s: %d copied, %d already done, %d failed", *fromName, *toName, copied, skipped, failed)
+	if failed > 0 {
+		log.Warnf("Run the migration again to retry the failed files")
+	}
+}
+
+// migrateRecord streams one archived file to the destination named toName and rewrites its state record to point at the copy
+func migrateRecord(from, to StorageProvider, toName string, state *StateStore, record *FileRecord) error {
+	ref := FileRef{Path: recordPath(record)}
+	if from.Capabilities().StatByID {
+		ref.ID = record.RemoteID
+	}
+
+	if err := checkUploadSize(to, int64(record.Size), ref.Path); err != nil {
+		return err
+	}
+
+	var start time.Time
+	remote, digest, err := uploadVerifiedFrom(to, func() (io.ReadCloser, error) {
+		start = time.Now()
+		file, err := from.Open(ref)
+		if os.IsNotExist(err) {
+			log.Warnf("%s is missing from %s, it can't be migrated", ref.Path, from.GetName())
+		}
+		return file, err
+	}, ref.Path)
+	if err != nil {
+		return err
+	}
+	// The download is streamed into the upload, so it lasts as long as the upload does
+	downloadDuration.WithLabelValues(from.GetName()).Observe(time.Since(start).Seconds())
+	downloadBytes.WithLabelValues(from.GetName()).Add(float64(digest.size))
+
+	if hash := hex.EncodeToString(digest.sha256.Sum(nil)); record.SHA256 != "" && hash != record.SHA256 {
+		log.Warnf("%s on %s doesn't match the archived sha256, copied it anyway", ref.Path, from.GetName())
+	}
+
+	moved := *record
+	moved.Destination = toName
+	moved.Path = ref.Path
+	if remote.Path != "" {
+		moved.Path = remote.Path
+	}
+	moved.RemoteID = remote.ID
+	state.recordFile(&moved)
+
+	log.Debugf("Migrated %s to %s", ref.Path, to.GetName())
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// OAuth flows used to obtain an initial token
+const (
+	oauthFlowBrowser           = "browser"
+	oauthFlowDevice            = "device"
+	oauthFlowClientCredentials = "client_credentials"
+)
+
+// fetchDeviceToken obtains a token with the OAuth 2.0 device authorization grant.
+// The user enters a short code on another device, so no browser has to reach this process.
+func fetchDeviceToken(config *oauth2.Config, providerName string) (*oauth2.Token, error) {
+	ctx := context.Background()
+
+	deviceAuth, err := config.DeviceAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %s device code: %v", providerName, err)
+	}
+
+	verificationURI := deviceAuth.VerificationURI
+	if deviceAuth.VerificationURIComplete != "" {
+		verificationURI = deviceAuth.VerificationURIComplete
+	}
+	log.Errorf("To authorize %s, go to %s on any device and enter the code %s", providerName, verificationURI, deviceAuth.UserCode)
+	log.Errorf("Waiting for authorization until %s", deviceAuth.Expiry.Format("15:04:05"))
+
+	// DeviceAccessToken polls the token endpoint at the interval the server asked for until the user responds
+	token, err := config.DeviceAccessToken(ctx, deviceAuth)
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for %s device authorization: %v", providerName, err)
+	}
+
+	log.Infof("Successfully obtained %s OAuth token", providerName)
+	return token, nil
+}
+
+// oauthClient returns an HTTP client authorized with the token stored in tokenFile.
+// An expired access token is refreshed with the stored refresh token; fetch is only called to
+// authorize from scratch when there is no usable token or the refresh token is missing or has been revoked.
+// Other refresh failures, such as network errors, are returned rather than starting a new authorization.
+func oauthClient(config *oauth2.Config, tokenFile, providerName string, fetch func(*oauth2.Config) (*oauth2.Token, error)) (*http.Client, error) {
+	ctx := context.Background()
+
+	token, err := tokenFromFile(tokenFile)
+	if err != nil {
+		log.Warnf("Could not use %s OAuth token from file: %v. Fetching new token.", providerName, err)
+		token = nil
+	} else if !token.Valid() && token.RefreshToken == "" {
+		log.Warnf("%s OAuth token has expired and has no refresh token. Fetching new token.", providerName)
+		token = nil
+	} else if !token.Valid() {
+		refreshed, err := config.TokenSource(ctx, token).Token()
+		switch {
+		case err == nil:
+			oauthTokenRefreshes.WithLabelValues(providerName, "success").Inc()
+			oauthTokenRefreshedTime.WithLabelValues(providerName).SetToCurrentTime()
+			saveTokenToFile(refreshed, tokenFile)
+			token = refreshed
+		case isRevokedGrant(err):
+			log.Warnf("%s refresh token has been revoked or has expired: %v. Fetching new token.", providerName, err)
+			oauthTokenRefreshes.WithLabelValues(providerName, "failure").Inc()
+			token = nil
+		default:
+			oauthTokenRefreshes.WithLabelValues(providerName, "failure").Inc()
+			return nil, fmt.Errorf("error refreshing %s OAuth token: %v", providerName, err)
+		}
+	}
+
+	if token == nil {
+		token, err = fetch(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch initial %s token: %v", providerName, err)
+		}
+		saveTokenToFile(token, tokenFile)
+		oauthTokenRefreshedTime.WithLabelValues(providerName).SetToCurrentTime()
+	}
+
+	source := &persistingTokenSource{
+		base:         config.TokenSource(ctx, token),
+		tokenFile:    tokenFile,
+		providerName: providerName,
+		last:         token,
+	}
+	return oauth2.NewClient(ctx, source), nil
+}
+
+// isRevokedGrant reports whether a token endpoint rejected the refresh token itself,
+// which only a new authorization can fix
+func isRevokedGrant(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant"
+}
+
+// persistingTokenSource writes every refreshed token back to the token file,
+// so a restart picks up the latest access and refresh tokens.
+type persistingTokenSource struct {
+	base         oauth2.TokenSource
+	tokenFile    string
+	providerName string
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+// Token returns a valid token, refreshing and persisting it when it has expired
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := p.base.Token()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		log.Errorf("Error refreshing %s OAuth token: %v", p.providerName, err)
+		oauthTokenRefreshes.WithLabelValues(p.providerName, "failure").Inc()
+		return nil, err
+	}
+
+	if token.AccessToken != p.last.AccessToken {
+		log.Debugf("%s OAuth token refreshed, valid until %s", p.providerName, token.Expiry)
+		oauthTokenRefreshes.WithLabelValues(p.providerName, "success").Inc()
+		oauthTokenRefreshedTime.WithLabelValues(p.providerName).SetToCurrentTime()
+
+		// Some servers only return a refresh token on the first exchange
+		if token.RefreshToken == "" {
+			token.RefreshToken = p.last.RefreshToken
+		}
+		if err := writeTokenFile(token, p.tokenFile); err != nil {
+			log.Errorf("Error persisting refreshed %s OAuth token: %v", p.providerName, err)
+		}
+		p.last = token
+	}
+
+	return token, nil
+}
+
+// saveTokenToFile saves an OAuth 2.0 token to a file
+func saveTokenToFile(token *oauth2.Token, tokenFile string) {
+	if err := writeTokenFile(token, tokenFile); err != nil {
+		log.Fatalf("Error saving token file: %v", err)
+	}
+}
+
+// writeTokenFile replaces the stored token in the configured token store
+func writeTokenFile(token *oauth2.Token, tokenFile string) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("error encoding token: %v", err)
+	}
+	return tokenStore.Save(tokenFile, data)
+}
+
+// tokenFromFile loads a previously obtained OAuth 2.0 token from the configured token store.
+// An expired access token is still usable as long as the token carries a refresh token.
+func tokenFromFile(file string) (*oauth2.Token, error) {
+	data, err := tokenStore.Load(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening token file: %v", err)
+	}
+
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("error decoding token: %v", err)
+	}
+
+	if token.RefreshToken == "" && token.Expiry.Before(time.Now()) {
+		return nil, fmt.Errorf("OAuth token has expired and has no refresh token")
+	}
+
+	return token, nil
+}
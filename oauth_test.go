@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/oauth2"
+)
+
+// fakeDeviceServer serves a device authorization endpoint, and a token endpoint answering each poll with the next response
+func fakeDeviceServer(t *testing.T, responses []func(w http.ResponseWriter)) (*oauth2.Config, *atomic.Int32) {
+	t.Helper()
+	polls := &atomic.Int32{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("client_id") != "client" {
+			t.Errorf("device authorization request without client_id: %v", r.Form)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"device_code":      "device-code",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": "https://example.com/device",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("error parsing token request: %v", err)
+		}
+		if grant := r.Form.Get("grant_type"); grant != "urn:ietf:params:oauth:grant-type:device_code" {
+			t.Errorf("grant_type = %q", grant)
+		}
+		if code := r.Form.Get("device_code"); code != "device-code" {
+			t.Errorf("device_code = %q", code)
+		}
+
+		poll := int(polls.Add(1)) - 1
+		if poll >= len(responses) {
+			t.Errorf("unexpected poll %d", poll+1)
+			writeOAuthError(w, "expired_token")
+			return
+		}
+		responses[poll](w)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{
+			DeviceAuthURL: server.URL + "/device",
+			TokenURL:      server.URL + "/token",
+			AuthStyle:     oauth2.AuthStyleInParams,
+		},
+	}, polls
+}
+
+// writeOAuthError answers a token request with an OAuth error code
+func writeOAuthError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+// writeOAuthToken answers a token request with a token
+func writeOAuthToken(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token":  "access-token",
+		"refresh_token": "refresh-token",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+func TestFetchDeviceToken(t *testing.T) {
+	pending := func(w http.ResponseWriter) { writeOAuthError(w, "authorization_pending") }
+
+	tests := []struct {
+		name      string
+		responses []func(w http.ResponseWriter)
+		wantErr   string
+		wantPolls int32
+	}{
+		{
+			name:      "approved right away",
+			responses: []func(w http.ResponseWriter){writeOAuthToken},
+			wantPolls: 1,
+		},
+		{
+			name:      "approved after polling",
+			responses: []func(w http.ResponseWriter){pending, pending, writeOAuthToken},
+			wantPolls: 3,
+		},
+		{
+			name:      "denied",
+			responses: []func(w http.ResponseWriter){pending, func(w http.ResponseWriter) { writeOAuthError(w, "access_denied") }},
+			wantErr:   "access_denied",
+			wantPolls: 2,
+		},
+		{
+			name:      "code expired",
+			responses: []func(w http.ResponseWriter){func(w http.ResponseWriter) { writeOAuthError(w, "expired_token") }},
+			wantErr:   "expired_token",
+			wantPolls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel() // each poll waits the 1 second interval
+			config, polls := fakeDeviceServer(t, test.responses)
+
+			token, err := fetchDeviceToken(config, "Test")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("fetchDeviceToken() error = %v, want %s", err, test.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("fetchDeviceToken() error = %v", err)
+				}
+				if token.AccessToken != "access-token" || token.RefreshToken != "refresh-token" {
+					t.Errorf("fetchDeviceToken() = %+v", token)
+				}
+			}
+
+			if got := polls.Load(); got != test.wantPolls {
+				t.Errorf("token endpoint polled %d times, want %d", got, test.wantPolls)
+			}
+		})
+	}
+}
+
+func TestOAuthClientStartup(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         *oauth2.Token
+		status        int
+		response      func(w http.ResponseWriter)
+		wantFetch     bool
+		wantErr       bool
+		wantRefreshed bool
+	}{
+		{
+			name:  "valid token",
+			token: &oauth2.Token{AccessToken: "old", RefreshToken: "refresh-token", Expiry: time.Now().Add(time.Hour)},
+		},
+		{
+			name:          "expired token is refreshed",
+			token:         &oauth2.Token{AccessToken: "old", RefreshToken: "refresh-token", Expiry: time.Now().Add(-time.Hour)},
+			response:      writeOAuthToken,
+			wantRefreshed: true,
+		},
+		{
+			name:          "revoked refresh token",
+			token:         &oauth2.Token{AccessToken: "old", RefreshToken: "refresh-token", Expiry: time.Now().Add(-time.Hour)},
+			response:      func(w http.ResponseWriter) { writeOAuthError(w, "invalid_grant") },
+			wantFetch:     true,
+			wantRefreshed: true,
+		},
+		{
+			name:     "token endpoint unavailable",
+			token:    &oauth2.Token{AccessToken: "old", RefreshToken: "refresh-token", Expiry: time.Now().Add(-time.Hour)},
+			response: func(w http.ResponseWriter) { http.Error(w, "unavailable", http.StatusServiceUnavailable) },
+			wantErr:  true,
+		},
+		{
+			name:          "missing refresh token",
+			token:         &oauth2.Token{AccessToken: "old", Expiry: time.Now().Add(-time.Hour)},
+			wantFetch:     true,
+			wantRefreshed: true,
+		},
+		{
+			name:          "missing token file",
+			wantFetch:     true,
+			wantRefreshed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.response == nil {
+					t.Errorf("token endpoint called unexpectedly")
+					writeOAuthError(w, "invalid_request")
+					return
+				}
+				test.response(w)
+			}))
+			defer server.Close()
+
+			tokenFile := filepath.Join(t.TempDir(), "token.json")
+			if test.token != nil {
+				if err := writeTokenFile(test.token, tokenFile); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams}}
+
+			fetched := false
+			provider := "Test " + test.name
+			_, err := oauthClient(config, tokenFile, provider, func(*oauth2.Config) (*oauth2.Token, error) {
+				fetched = true
+				return &oauth2.Token{AccessToken: "fetched", RefreshToken: "new-refresh-token", Expiry: time.Now().Add(time.Hour)}, nil
+			})
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("oauthClient() error = %v, want error %v", err, test.wantErr)
+			}
+			if fetched != test.wantFetch {
+				t.Errorf("authorized from scratch = %v, want %v", fetched, test.wantFetch)
+			}
+			gauge := &dto.Metric{}
+			if err := oauthTokenRefreshedTime.WithLabelValues(provider).Write(gauge); err != nil {
+				t.Fatal(err)
+			}
+			refreshed := gauge.GetGauge().GetValue() != 0
+			if refreshed != test.wantRefreshed {
+				t.Errorf("refreshed timestamp set = %v, want %v", refreshed, test.wantRefreshed)
+			}
+		})
+	}
+}
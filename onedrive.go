@@ -2,12 +2,13 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"time"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
@@ -18,16 +19,27 @@ import (
 // for OneDrive Personal accounts (live.com, outlook.com, hotmail.com).
 // Note: This is different from Azure AD endpoints used for work/school accounts.
 var MicrosoftLiveEndpoint = oauth2.Endpoint{
-	AuthURL:   "https://login.live.com/oauth20_authorize.srf",
-	TokenURL:  "https://login.live.com/oauth20_token.srf",
-	AuthStyle: oauth2.AuthStyleInParams, // Required: send credentials in POST body, not HTTP Basic Auth
+	AuthURL:       "https://login.live.com/oauth20_authorize.srf",
+	TokenURL:      "https://login.live.com/oauth20_token.srf",
+	DeviceAuthURL: "https://login.live.com/oauth20_connect.srf",
+	AuthStyle:     oauth2.AuthStyleInParams, // Required: send credentials in POST body, not HTTP Basic Auth
 }
 
-// OneDriveStorage implements StorageProvider for OneDrive Personal accounts.
-// It uses the OneDrive API (api.onedrive.com) rather than Microsoft Graph API.
+// oneDrivePersonalAPI is the drive endpoint of the OneDrive API for personal accounts
+const oneDrivePersonalAPI = "https://api.onedrive.com/v1.0/drive"
+
+// oneDriveSimpleUploadLimit is the largest file the simple upload API accepts
+const oneDriveSimpleUploadLimit = 4 * 1024 * 1024
+
+// OneDriveStorage implements StorageProvider for OneDrive.
+// Personal accounts use the OneDrive API (api.onedrive.com); work/school accounts and SharePoint
+// document libraries use the same drive endpoints through Microsoft Graph (see graph.go).
 type OneDriveStorage struct {
-	client *http.Client
-	config *oauth2.Config
+	client  *http.Client
+	config  *oauth2.Config
+	folder  string
+	baseURL string
+	name    string
 }
 
 // NewOneDriveStorage creates a new OneDrive storage provider for personal Microsoft accounts.
@@ -38,7 +50,8 @@ type OneDriveStorage struct {
 //   - Supported account types: "Personal Microsoft accounts only"
 //   - Platform: "Mobile and desktop applications"
 //   - Redirect URI: http://localhost:8888/onedrive (or custom via ONEDRIVE_REDIRECT_URL)
-func NewOneDriveStorage(clientID, clientSecret, tokenFile string) *OneDriveStorage {
+//   - Allow public client flows: Yes (only needed for the "device" authFlow)
+func NewOneDriveStorage(clientID, clientSecret, tokenFile, folder, authFlow string) *OneDriveStorage {
 	// For personal Microsoft accounts (public client apps), we don't send a client secret.
 	// The Azure app must be registered as a public client (Mobile and desktop applications).
 	config := &oauth2.Config{
@@ -53,111 +66,204 @@ func NewOneDriveStorage(clientID, clientSecret, tokenFile string) *OneDriveStora
 		config.RedirectURL = "http://localhost:8888/onedrive"
 	}
 
-	needFetchToken := false
-	var token *oauth2.Token
-	var err error
-
-	if _, err := os.Stat(tokenFile); os.IsNotExist(err) {
-		log.Warnf("OneDrive token file not found. Fetching new token.")
-		needFetchToken = true
-	} else {
-		token, err = tokenFromFile(tokenFile)
-		if err != nil {
-			log.Warnf("Error loading OneDrive OAuth token from file: %v", err)
-			needFetchToken = true
+	client, err := oauthClient(config, tokenFile, "OneDrive", func(config *oauth2.Config) (*oauth2.Token, error) {
+		if authFlow == oauthFlowDevice {
+			return fetchDeviceToken(config, "OneDrive")
 		}
+		return fetchBrowserToken(config, "OneDrive")
+	})
+	if err != nil {
+		log.Fatalf("Error authorizing OneDrive: %v", err)
 	}
+	return &OneDriveStorage{
+		client:  client,
+		config:  config,
+		folder:  folder,
+		baseURL: oneDrivePersonalAPI,
+		name:    "OneDrive",
+	}
+}
 
-	if needFetchToken {
-		token, err = fetchOneDriveToken(config)
-		if err != nil {
-			log.Fatalf("Failed to fetch initial OneDrive token: %v", err)
-		}
-		saveTokenToFile(token, tokenFile)
+// Upload uploads a file to OneDrive
+func (o *OneDriveStorage) Upload(data io.Reader, filename string) (*RemoteFile, error) {
+	return uploadToOneDrive(o.client, o.baseURL, data, filename, o.folder)
+}
+
+// Stat returns a file by its item ID, or by its path under the root folder
+func (o *OneDriveStorage) Stat(ref FileRef) (*RemoteFile, error) {
+	resp, err := o.client.Get(o.itemURL(ref))
+	if err != nil {
+		return nil, fmt.Errorf("error reading OneDrive item: %v", err)
 	}
+	defer resp.Body.Close()
 
-	client := config.Client(context.Background(), token)
-	return &OneDriveStorage{
-		client: client,
-		config: config,
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error reading OneDrive item, status: %d", resp.StatusCode)
+	}
+
+	var item oneDriveItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, fmt.Errorf("error decoding item response: %v", err)
+	}
+	if item.Folder != nil {
+		return nil, os.ErrNotExist
+	}
+
+	remote := item.remoteFile()
+	remote.Path = ref.Path
+	return remote, nil
 }
 
-// Upload uploads a file to OneDrive
-func (o *OneDriveStorage) Upload(data *bytes.Buffer, filename string) error {
-	return uploadToOneDrive(o.client, data, filename)
+// Open downloads a file by its item ID or path
+func (o *OneDriveStorage) Open(ref FileRef) (io.ReadCloser, error) {
+	contentURL := o.itemURL(ref) + "/content"
+	if ref.ID == "" {
+		contentURL = o.itemURL(ref) + ":/content"
+	}
+
+	resp, err := o.client.Get(contentURL)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading OneDrive item: %v", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error downloading OneDrive item, status: %d", resp.StatusCode)
+	}
+	return resp.Body, nil
 }
 
-// GetName returns the storage provider name
-func (o *OneDriveStorage) GetName() string {
-	return "OneDrive"
+// Exists reports whether a file exists by its item ID or path
+func (o *OneDriveStorage) Exists(ref FileRef) (bool, error) {
+	return statExists(o.Stat(ref))
 }
 
-// fetchOneDriveToken starts a local HTTP server to receive the OAuth authorization code
-// via the redirect URI callback. The user must visit the authorization URL in their browser
-// and grant permission to the application.
-func fetchOneDriveToken(config *oauth2.Config) (*oauth2.Token, error) {
-	authCodeChannel := make(chan string)
-	errorChannel := make(chan error)
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/onedrive", func(w http.ResponseWriter, r *http.Request) {
-		authCode := r.URL.Query().Get("code")
-		if authCode == "" {
-			http.Error(w, "Authorization code not found", http.StatusBadRequest)
-			errorChannel <- fmt.Errorf("authorization code not found")
-			return
-		}
-		authCodeChannel <- authCode
-		fmt.Fprintf(w, "OneDrive authorization successful! You can close this window.")
-	})
+// List returns one page of the files under the root folder.
+// Subfolders are queued and listed after the folder containing them.
+func (o *OneDriveStorage) List(pageToken string) ([]*RemoteFile, string, error) {
+	cursor, err := decodeListCursor(pageToken, listFolder{})
+	if err != nil {
+		return nil, "", err
+	}
 
-	HTTP_PORT := "8888"
-	if os.Getenv("HTTP_PORT") != "" {
-		HTTP_PORT = os.Getenv("HTTP_PORT")
+	folder := cursor.Folders[0]
+	listURL := cursor.Page
+	if listURL == "" && folder.ID == "" {
+		listURL = fmt.Sprintf("%s/root:/%s:/children", o.baseURL, url.PathEscape(o.folder))
+	} else if listURL == "" {
+		listURL = fmt.Sprintf("%s/items/%s/children", o.baseURL, folder.ID)
 	}
 
-	server := &http.Server{
-		Addr:    ":" + HTTP_PORT,
-		Handler: mux,
+	resp, err := o.client.Get(listURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing OneDrive folder: %v", err)
 	}
+	defer resp.Body.Close()
 
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Errorf("Error starting HTTP server: %v", err)
-		}
-	}()
-
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
-	log.Error("Go to the following link in your browser, authorize the app, and return:")
-	log.Errorf("%s", authURL)
-
-	select {
-	case authCode := <-authCodeChannel:
-		log.Debugf("Received authorization code, exchanging for token...")
-		// Shutdown the server after receiving the code
-		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			server.Shutdown(ctx)
-		}()
-
-		token, err := config.Exchange(context.Background(), authCode)
-		if err != nil {
-			return nil, fmt.Errorf("error exchanging authorization code for token: %v", err)
+	// The root folder is only created by the first upload
+	if resp.StatusCode == http.StatusNotFound && folder.ID == "" {
+		return []*RemoteFile{}, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("error listing OneDrive folder, status: %d", resp.StatusCode)
+	}
+
+	var page struct {
+		Value    []oneDriveItem `json:"value"`
+		NextLink string         `json:"@odata.nextLink"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, "", fmt.Errorf("error decoding list response: %v", err)
+	}
+
+	files := []*RemoteFile{}
+	for _, item := range page.Value {
+		if item.Folder != nil {
+			cursor.Folders = append(cursor.Folders, listFolder{ID: item.ID, Prefix: folder.Prefix + item.Name + "/"})
+			continue
 		}
-		log.Infof("Successfully obtained OneDrive OAuth token")
-		return token, nil
-	case err := <-errorChannel:
-		return nil, err
+
+		remote := item.remoteFile()
+		remote.Path = folder.Prefix + item.Name
+		files = append(files, remote)
+	}
+
+	cursor.advance(page.NextLink)
+	return files, cursor.encode(), nil
+}
+
+// Delete removes a file by its item ID or path
+func (o *OneDriveStorage) Delete(ref FileRef) error {
+	req, err := http.NewRequest("DELETE", o.itemURL(ref), nil)
+	if err != nil {
+		return fmt.Errorf("error creating delete request: %v", err)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error deleting OneDrive item: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error deleting OneDrive item, status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Capabilities describes OneDrive. Only personal accounts report sha1 hashes.
+func (o *OneDriveStorage) Capabilities() StorageCapabilities {
+	checksums := []string{"quickXorHash"}
+	if o.baseURL == oneDrivePersonalAPI {
+		checksums = append(checksums, "sha1")
+	}
+	return StorageCapabilities{
+		List:          true,
+		StatByID:      true,
+		StatByPath:    true,
+		Delete:        true,
+		Checksums:     checksums,
+		MaxUploadSize: oneDriveSimpleUploadLimit,
 	}
 }
 
+// itemURL addresses a drive item by its ID, or by its path under the root folder
+func (o *OneDriveStorage) itemURL(ref FileRef) string {
+	if ref.ID != "" {
+		return fmt.Sprintf("%s/items/%s", o.baseURL, url.PathEscape(ref.ID))
+	}
+	return fmt.Sprintf("%s/root:/%s", o.baseURL, oneDrivePath(o.folder+"/"+ref.Path))
+}
+
+// oneDrivePath escapes every segment of a slash separated path for path-based addressing
+func oneDrivePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// GetName returns the storage provider name
+func (o *OneDriveStorage) GetName() string {
+	return o.name
+}
+
 // getOrCreateOneDriveFolder retrieves the ID of an existing folder by name or creates it if it doesn't exist.
-// Uses the OneDrive API (api.onedrive.com) which is required for personal Microsoft accounts
-// when authenticating via the Microsoft Live endpoint with onedrive.readwrite scope.
-func getOrCreateOneDriveFolder(client *http.Client, folderName string) (string, error) {
-	listURL := "https://api.onedrive.com/v1.0/drive/root/children"
+// baseURL is the drive endpoint: the OneDrive API (api.onedrive.com), which is required for personal
+// Microsoft accounts authenticating via the Microsoft Live endpoint, or a Microsoft Graph drive.
+func getOrCreateOneDriveFolder(client *http.Client, baseURL, folderName string) (string, error) {
+	listURL := baseURL + "/root/children"
 
 	resp, err := client.Get(listURL)
 	if err != nil {
@@ -191,7 +297,7 @@ func getOrCreateOneDriveFolder(client *http.Client, folderName string) (string,
 	}
 
 	// Create the folder if it doesn't exist
-	createURL := "https://api.onedrive.com/v1.0/drive/root/children"
+	createURL := baseURL + "/root/children"
 	folderData := map[string]interface{}{
 		"name":                   folderName,
 		"folder":                 map[string]interface{}{},
@@ -230,41 +336,43 @@ func getOrCreateOneDriveFolder(client *http.Client, folderName string) (string,
 	return folder.ID, nil
 }
 
-// uploadToOneDrive uploads a file from memory to the "discord-export" folder in OneDrive.
+// uploadToOneDrive uploads a file to the given folder in OneDrive.
+// A filename containing slashes is uploaded into matching subfolders, which OneDrive creates as needed.
 // Uses simple upload (PUT request) which supports files up to 4MB. For larger files,
-// OneDrive's resumable upload API should be used instead.
-func uploadToOneDrive(client *http.Client, data *bytes.Buffer, filename string) error {
-	start := time.Now()
-	folderName := "discord-export"
-
+// OneDrive's resumable upload API should be used instead. The simple upload needs the length up front,
+// so the file is read into memory first.
+func uploadToOneDrive(client *http.Client, baseURL string, data io.Reader, filename, folderName string) (*RemoteFile, error) {
 	// Ensure the target folder exists (creates it if needed)
-	_, err := getOrCreateOneDriveFolder(client, folderName)
+	_, err := getOrCreateOneDriveFolder(client, baseURL, folderName)
 	if err != nil {
-		return fmt.Errorf("error ensuring OneDrive folder exists: %v", err)
+		return nil, fmt.Errorf("error ensuring OneDrive folder exists: %v", err)
 	}
 
 	// Upload file using path-based addressing
-	uploadURL := fmt.Sprintf("https://api.onedrive.com/v1.0/drive/root:/%s/%s:/content", folderName, filename)
+	uploadURL := fmt.Sprintf("%s/root:/%s:/content", baseURL, oneDrivePath(folderName+"/"+filename))
 
-	req, err := http.NewRequest("PUT", uploadURL, data)
+	payload, err := io.ReadAll(data)
 	if err != nil {
-		return fmt.Errorf("error creating upload request: %v", err)
+		return nil, fmt.Errorf("error reading %s for upload: %v", filename, err)
+	}
+
+	req, err := http.NewRequest("PUT", uploadURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error creating upload request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to upload %s to OneDrive: %v", filename, err)
+		return nil, fmt.Errorf("failed to upload %s to OneDrive: %v", filename, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to upload %s to OneDrive, status: %d", filename, resp.StatusCode)
+		return nil, fmt.Errorf("failed to upload %s to OneDrive, status: %d", filename, resp.StatusCode)
 	}
 
-	var uploadResult struct {
-		ID string `json:"id"`
-	}
+	var uploadResult oneDriveItem
 
 	if err := json.NewDecoder(resp.Body).Decode(&uploadResult); err != nil {
 		log.Warnf("Could not decode upload response, but upload may have succeeded")
@@ -272,9 +380,35 @@ func uploadToOneDrive(client *http.Client, data *bytes.Buffer, filename string)
 
 	log.Debugf("File uploaded to OneDrive in folder %s with ID: %s", folderName, uploadResult.ID)
 
-	// Record upload duration metric (reuses Google Drive metric for now)
-	// TODO: Add OneDrive-specific metrics
-	googleDriveUploadDuration.WithLabelValues().Observe(float64(time.Since(start).Seconds()))
+	remote := uploadResult.remoteFile()
+	remote.Path = filename
+	return remote, nil
+}
 
-	return nil
+// oneDriveItem is the subset of a OneDrive driveItem resource the reaper reads
+type oneDriveItem struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Folder *struct {
+		ChildCount int `json:"childCount"`
+	} `json:"folder,omitempty"`
+	File *struct {
+		Hashes struct {
+			SHA1Hash     string `json:"sha1Hash"`
+			SHA256Hash   string `json:"sha256Hash"`
+			QuickXorHash string `json:"quickXorHash"`
+		} `json:"hashes"`
+	} `json:"file,omitempty"`
+}
+
+// remoteFile converts the item into the provider independent description
+func (item *oneDriveItem) remoteFile() *RemoteFile {
+	remote := &RemoteFile{ID: item.ID, Name: item.Name, Size: item.Size}
+	if item.File != nil {
+		remote.SHA1 = item.File.Hashes.SHA1Hash
+		remote.SHA256 = item.File.Hashes.SHA256Hash
+		remote.QuickXorHash = item.File.Hashes.QuickXorHash
+	}
+	return remote
 }
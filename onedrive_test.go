@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeOneDrivePageSize is small so listings exercise @odata.nextLink
+const fakeOneDrivePageSize = 2
+
+// fakeOneDrive serves the driveItem endpoints of a drive held in memory
+type fakeOneDrive struct {
+	mu     sync.Mutex
+	url    string
+	items  []*fakeOneDriveItem // in creation order, the root first
+	nextID int
+}
+
+type fakeOneDriveItem struct {
+	id      string
+	name    string
+	parent  *fakeOneDriveItem
+	folder  bool
+	content []byte
+}
+
+// newFakeOneDrive starts a fake drive and returns a provider using it
+func newFakeOneDrive(t *testing.T) *OneDriveStorage {
+	fake := &fakeOneDrive{items: []*fakeOneDriveItem{{id: "root", folder: true}}}
+	server := httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(server.Close)
+	fake.url = server.URL
+
+	return &OneDriveStorage{client: server.Client(), folder: "discord-export", baseURL: server.URL, name: "OneDrive"}
+}
+
+func (f *fakeOneDrive) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case path == "/root/children" && r.Method == http.MethodPost:
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, f.create(f.items[0], body.Name, true, nil).json())
+	case path == "/root/children":
+		f.serveChildren(w, r, f.items[0])
+	case strings.HasPrefix(path, "/root:/") && strings.HasSuffix(path, ":/content") && r.Method == http.MethodPut:
+		f.serveUpload(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "/root:/"), ":/content"))
+	case strings.HasPrefix(path, "/root:/"):
+		path = strings.TrimPrefix(path, "/root:/")
+		suffix := ""
+		for _, s := range []string{":/content", ":/children"} {
+			if strings.HasSuffix(path, s) {
+				path, suffix = strings.TrimSuffix(path, s), s
+			}
+		}
+		f.serveItem(w, r, f.lookupPath(path), suffix)
+	case strings.HasPrefix(path, "/items/"):
+		id, suffix, _ := strings.Cut(strings.TrimPrefix(path, "/items/"), "/")
+		if suffix != "" {
+			suffix = ":/" + suffix
+		}
+		f.serveItem(w, r, f.lookupID(id), suffix)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveItem answers reads and deletes of one item, or of its content or children when suffix says so
+func (f *fakeOneDrive) serveItem(w http.ResponseWriter, r *http.Request, item *fakeOneDriveItem, suffix string) {
+	if item == nil {
+		writeJSON(w, http.StatusNotFound, map[string]any{"error": map[string]string{"code": "itemNotFound"}})
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodDelete && suffix == "":
+		f.items = deleteItem(f.items, item)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case suffix == ":/content" && !item.folder:
+		w.Write(item.content)
+	case suffix == ":/children" && item.folder:
+		f.serveChildren(w, r, item)
+	case suffix == "":
+		writeJSON(w, http.StatusOK, item.json())
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+// serveChildren answers one page of a folder's children, linking to the next one
+func (f *fakeOneDrive) serveChildren(w http.ResponseWriter, r *http.Request, folder *fakeOneDriveItem) {
+	children := []map[string]any{}
+	for _, item := range f.items {
+		if item.parent == folder {
+			children = append(children, item.json())
+		}
+	}
+
+	skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+	end := min(skip+fakeOneDrivePageSize, len(children))
+	page := map[string]any{"value": children[min(skip, end):end]}
+	if end < len(children) {
+		page["@odata.nextLink"] = f.url + "/items/" + folder.id + "/children?skip=" + strconv.Itoa(end)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// serveUpload stores a file at path, creating missing folders and replacing an existing file
+func (f *fakeOneDrive) serveUpload(w http.ResponseWriter, r *http.Request, path string) {
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	parent := f.items[0]
+	names := strings.Split(path, "/")
+	for _, name := range names[:len(names)-1] {
+		folder := f.child(parent, name)
+		if folder == nil {
+			folder = f.create(parent, name, true, nil)
+		}
+		parent = folder
+	}
+
+	if existing := f.child(parent, names[len(names)-1]); existing != nil {
+		existing.content = content
+		writeJSON(w, http.StatusOK, existing.json())
+		return
+	}
+	writeJSON(w, http.StatusCreated, f.create(parent, names[len(names)-1], false, content).json())
+}
+
+func (f *fakeOneDrive) create(parent *fakeOneDriveItem, name string, folder bool, content []byte) *fakeOneDriveItem {
+	f.nextID++
+	item := &fakeOneDriveItem{id: "item" + strconv.Itoa(f.nextID), name: name, parent: parent, folder: folder, content: content}
+	f.items = append(f.items, item)
+	return item
+}
+
+func (f *fakeOneDrive) child(parent *fakeOneDriveItem, name string) *fakeOneDriveItem {
+	for _, item := range f.items {
+		if item.parent == parent && strings.EqualFold(item.name, name) {
+			return item
+		}
+	}
+	return nil
+}
+
+func (f *fakeOneDrive) lookupPath(path string) *fakeOneDriveItem {
+	item := f.items[0]
+	for _, name := range strings.Split(path, "/") {
+		if item = f.child(item, name); item == nil {
+			return nil
+		}
+	}
+	return item
+}
+
+func (f *fakeOneDrive) lookupID(id string) *fakeOneDriveItem {
+	for _, item := range f.items {
+		if item.id == id {
+			return item
+		}
+	}
+	return nil
+}
+
+// deleteItem removes item and everything inside it
+func deleteItem(items []*fakeOneDriveItem, item *fakeOneDriveItem) []*fakeOneDriveItem {
+	kept := []*fakeOneDriveItem{}
+	for _, candidate := range items {
+		inside := false
+		for parent := candidate; parent != nil; parent = parent.parent {
+			inside = inside || parent == item
+		}
+		if !inside {
+			kept = append(kept, candidate)
+		}
+	}
+	return kept
+}
+
+// json renders the item as a driveItem resource
+func (item *fakeOneDriveItem) json() map[string]any {
+	resource := map[string]any{"id": item.id, "name": item.name, "size": len(item.content)}
+	if item.folder {
+		resource["folder"] = map[string]any{"childCount": 0}
+		return resource
+	}
+
+	sum := sha1.Sum(item.content)
+	resource["file"] = map[string]any{"hashes": map[string]string{
+		"sha1Hash":     strings.ToUpper(hex.EncodeToString(sum[:])),
+		"quickXorHash": quickXorHash(item.content),
+	}}
+	return resource
+}
+
+func TestOneDriveStorageConformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) StorageProvider {
+		return newFakeOneDrive(t)
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OptOut is a user who asked for their attachments not to be archived
+type OptOut struct {
+	UserID string    `json:"user_id"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source,omitempty"` // where the opt-out was made, e.g. "cli"
+}
+
+// OptOutRegistry keeps the users who opted out in a file next to the state file.
+// JSON lines carry an OptOut, while plain lines hold just a user ID, so the file can also be written by hand.
+type OptOutRegistry struct {
+	path  string
+	users map[string]*OptOut // user ID -> opt-out
+	mu    sync.Mutex
+}
+
+// openOptOutRegistry loads the opt-outs previously recorded at path
+func openOptOutRegistry(path string) *OptOutRegistry {
+	users, err := readOptOuts(path)
+	if err != nil {
+		log.Fatalf("Error opening opt-out file: %v", err)
+	}
+	return &OptOutRegistry{path: path, users: users}
+}
+
+// readOptOuts reads the opt-outs recorded at path. A missing file holds none.
+func readOptOuts(path string) (map[string]*OptOut, error) {
+	users := map[string]*OptOut{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return users, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "{") {
+			users[line] = &OptOut{UserID: line}
+			continue
+		}
+
+		optOut := &OptOut{}
+		if err := json.Unmarshal([]byte(line), optOut); err != nil {
+			log.Errorf("Skipping malformed opt-out entry %q: %v", line, err)
+			continue
+		}
+		users[optOut.UserID] = optOut
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Error reading opt-out file: %v", err)
+	}
+
+	return users, nil
+}
+
+// reload reads the opt-out file again, picking up changes other processes made since it was loaded,
+// such as the optout command run while the archiver is running. Callers hold r.mu.
+func (r *OptOutRegistry) reload() {
+	users, err := readOptOuts(r.path)
+	if err != nil {
+		log.Errorf("Error reloading opt-out file, keeping the opt-outs loaded earlier: %v", err)
+		return
+	}
+	r.users = users
+}
+
+// optOutPath returns the opt-out file for a guild, next to its state file unless OPT_OUT_FILE is set
+func optOutPath(guildID string) string {
+	if path := guildEnv(guildID, "OPT_OUT_FILE"); path != "" {
+		return path
+	}
+	return guildEnv(guildID, "STATE_FILE") + ".optout"
+}
+
+// contains reports whether a user has opted out
+func (r *OptOutRegistry) contains(userID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.users[userID]
+	return ok
+}
+
+// add opts a user out. It returns false when the user had already opted out.
+func (r *OptOutRegistry) add(userID, source string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reload()
+	if _, ok := r.users[userID]; ok {
+		return false
+	}
+	r.users[userID] = &OptOut{UserID: userID, Time: time.Now(), Source: source}
+	r.save()
+	return true
+}
+
+// remove opts a user back in. It returns false when the user hadn't opted out.
+func (r *OptOutRegistry) remove(userID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reload()
+	if _, ok := r.users[userID]; !ok {
+		return false
+	}
+	delete(r.users, userID)
+	r.save()
+	return true
+}
+
+// list returns every opt-out, oldest first
+func (r *OptOutRegistry) list() []*OptOut {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	optOuts := []*OptOut{}
+	for _, optOut := range r.users {
+		optOuts = append(optOuts, optOut)
+	}
+	sort.Slice(optOuts, func(i, j int) bool { return optOuts[i].Time.Before(optOuts[j].Time) })
+	return optOuts
+}
+
+// save atomically rewrites the opt-out file. Callers hold r.mu, and reload first so other processes' changes are kept.
+func (r *OptOutRegistry) save() {
+	var lines strings.Builder
+	for _, optOut := range r.users {
+		line, err := json.Marshal(optOut)
+		if err != nil {
+			log.Errorf("Error encoding opt-out of %s: %v", optOut.UserID, err)
+			continue
+		}
+		lines.Write(line)
+		lines.WriteString("\n")
+	}
+
+	if err := writeFileAtomic(r.path, lines.String()); err != nil {
+		log.Errorf("Error writing opt-out file: %v", err)
+	}
+}
+
+// AuditEntry is a line of the audit log, recording a change made on behalf of a user's privacy choices
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	UserID      string    `json:"user_id"`
+	GuildID     string    `json:"guild_id,omitempty"`
+	Entity      string    `json:"entity,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Result      string    `json:"result,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Audited actions
+const (
+	auditOptOut     = "opt_out"
+	auditOptIn      = "opt_in"
+	auditPurgeFile  = "purge_file"
+	auditPurgeState = "purge_state"
+)
+
+// auditMu serialises appends to audit logs
+var auditMu sync.Mutex
+
+// auditLogPath returns the audit log for a guild, next to its state file unless AUDIT_LOG_FILE is set
+func auditLogPath(guildID string) string {
+	if path := guildEnv(guildID, "AUDIT_LOG_FILE"); path != "" {
+		return path
+	}
+	return guildEnv(guildID, "STATE_FILE") + ".audit"
+}
+
+// audit appends an entry to a guild's audit log and logs it
+func audit(guildID string, entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.GuildID == "" {
+		entry.GuildID = guildID
+	}
+	log.Infof("Audit: %s user=%s entity=%s destination=%s result=%s", entry.Action, entry.UserID, entry.Entity, entry.Destination, entry.Result)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Error encoding audit entry: %v", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	file, err := os.OpenFile(auditLogPath(guildID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorf("Error opening audit log: %v", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "%s\n", line); err != nil {
+		log.Errorf("Error writing audit log: %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Supported perceptual hash algorithms. Each produces a 64 bit hash.
+const (
+	phashAverage    = "ahash"
+	phashDifference = "dhash"
+	phashDCT        = "phash"
+)
+
+// perceptualHashSettings holds a guild's PHASH_* settings
+type perceptualHashSettings struct {
+	mode        string // "skip", "duplicates" or "annotate"
+	algorithm   string
+	maxDistance int
+}
+
+// parsePerceptualHashSettings reads the near-duplicate detection settings for a guild.
+// It returns nil when PHASH_MODE is unset or "off".
+func parsePerceptualHashSettings(guildID string) (*perceptualHashSettings, error) {
+	env := func(key string) string { return guildEnv(guildID, key) }
+	settings := &perceptualHashSettings{mode: env("PHASH_MODE"), algorithm: env("PHASH_ALGORITHM"), maxDistance: 5}
+
+	switch settings.mode {
+	case "", "off":
+		return nil, nil
+	case "skip", "duplicates", "annotate":
+	default:
+		return nil, fmt.Errorf("invalid PHASH_MODE: %q. Valid values are 'off', 'annotate', 'duplicates' or 'skip'", settings.mode)
+	}
+
+	switch settings.algorithm {
+	case "":
+		settings.algorithm = phashDifference
+	case phashAverage, phashDifference, phashDCT:
+	default:
+		return nil, fmt.Errorf("invalid PHASH_ALGORITHM: %q. Valid values are 'dhash', 'ahash' or 'phash'", settings.algorithm)
+	}
+
+	if env("PHASH_MAX_DISTANCE") != "" {
+		distance, err := strconv.Atoi(env("PHASH_MAX_DISTANCE"))
+		if err != nil || distance < 0 {
+			return nil, fmt.Errorf("invalid PHASH_MAX_DISTANCE: %q", env("PHASH_MAX_DISTANCE"))
+		}
+		settings.maxDistance = distance
+	}
+
+	return settings, nil
+}
+
+// phashMaxPixels caps the size of images decoded for hashing. A small compressed file can declare huge dimensions,
+// and decoding it would allocate 4 bytes per pixel.
+const phashMaxPixels = 50_000_000
+
+// computePerceptualHash hashes an image so that visually similar images produce hashes a small Hamming distance apart.
+// The result is formatted as "<algorithm>:<hex>" so hashes from different algorithms are never compared.
+func computePerceptualHash(data []byte, algorithm string) (string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("error decoding image header: %v", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > phashMaxPixels/config.Height {
+		return "", fmt.Errorf("image is %dx%d, larger than the %d pixels hashed", config.Width, config.Height, phashMaxPixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("error decoding image: %v", err)
+	}
+
+	var hash uint64
+	switch algorithm {
+	case phashAverage:
+		hash = averageHash(img)
+	case phashDifference:
+		hash = differenceHash(img)
+	case phashDCT:
+		hash = dctHash(img)
+	default:
+		return "", fmt.Errorf("unknown perceptual hash algorithm %q", algorithm)
+	}
+
+	return fmt.Sprintf("%s:%016x", algorithm, hash), nil
+}
+
+// perceptualHashDistance returns the Hamming distance between two hashes from computePerceptualHash.
+// ok is false when the hashes are malformed or were produced by different algorithms.
+func perceptualHashDistance(a, b string) (distance int, ok bool) {
+	algorithmA, hexA, foundA := strings.Cut(a, ":")
+	algorithmB, hexB, foundB := strings.Cut(b, ":")
+	if !foundA || !foundB || algorithmA != algorithmB {
+		return 0, false
+	}
+
+	hashA, errA := strconv.ParseUint(hexA, 16, 64)
+	hashB, errB := strconv.ParseUint(hexB, 16, 64)
+	if errA != nil || errB != nil {
+		return 0, false
+	}
+
+	return bits.OnesCount64(hashA ^ hashB), true
+}
+
+// averageHash sets a bit for every pixel of an 8x8 thumbnail brighter than the thumbnail's mean
+func averageHash(img image.Image) uint64 {
+	pixels := grayscaleThumbnail(img, 8, 8)
+
+	mean := 0.0
+	for _, p := range pixels {
+		mean += p
+	}
+	mean /= float64(len(pixels))
+
+	var hash uint64
+	for i, p := range pixels {
+		if p > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// differenceHash sets a bit for every pixel of a 9x8 thumbnail darker than its right hand neighbour
+func differenceHash(img image.Image) uint64 {
+	pixels := grayscaleThumbnail(img, 9, 8)
+
+	var hash uint64
+	bit := 0
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] < pixels[y*9+x+1] {
+				hash |= 1 << uint(bit)
+			}
+			bit++
+		}
+	}
+	return hash
+}
+
+// dctHash compares the lowest 8x8 frequencies of a 32x32 thumbnail's discrete cosine transform against their median
+func dctHash(img image.Image) uint64 {
+	const size = 32
+	pixels := grayscaleThumbnail(img, size, size)
+
+	// Separable 2D DCT-II: rows first, then columns
+	rows := make([]float64, size*size)
+	for y := 0; y < size; y++ {
+		copy(rows[y*size:(y+1)*size], dct1D(pixels[y*size:(y+1)*size]))
+	}
+	coefficients := make([]float64, size*size)
+	column := make([]float64, size)
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			column[y] = rows[y*size+x]
+		}
+		for y, v := range dct1D(column) {
+			coefficients[y*size+x] = v
+		}
+	}
+
+	lowFrequencies := make([]float64, 0, 64)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			lowFrequencies = append(lowFrequencies, coefficients[y*size+x])
+		}
+	}
+
+	// The DC term only reflects overall brightness, so leave it out of the median
+	sorted := append([]float64(nil), lowFrequencies[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, v := range lowFrequencies {
+		if v > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// dct1D computes the unnormalised DCT-II of values
+func dct1D(values []float64) []float64 {
+	n := len(values)
+	out := make([]float64, n)
+	for k := 0; k < n; k++ {
+		sum := 0.0
+		for i, v := range values {
+			sum += v * math.Cos(math.Pi/float64(n)*(float64(i)+0.5)*float64(k))
+		}
+		out[k] = sum
+	}
+	return out
+}
+
+// grayscaleThumbnail shrinks img to width x height by averaging the luminance of the pixels falling in each cell
+func grayscaleThumbnail(img image.Image, width, height int) []float64 {
+	bounds := img.Bounds()
+	sums := make([]float64, width*height)
+	counts := make([]float64, width*height)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		cellY := (y - bounds.Min.Y) * height / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cellX := (x - bounds.Min.X) * width / bounds.Dx()
+			r, g, b, _ := img.At(x, y).RGBA()
+			sums[cellY*width+cellX] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			counts[cellY*width+cellX]++
+		}
+	}
+
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= counts[i]
+		}
+	}
+	return sums
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// optOutCommand adds users to, removes them from or lists the opt-out registry of every configured guild
+func optOutCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: optout add|remove|list [user id...]")
+	}
+	action, userIDs := args[0], args[1:]
+	if action != "list" && len(userIDs) == 0 {
+		log.Fatalf("Usage: optout %s <user id...>", action)
+	}
+
+	dg, targets := setup()
+	defer dg.Close()
+
+	switch action {
+	case "add":
+		for _, target := range targets {
+			for _, userID := range userIDs {
+				if target.OptOuts.add(userID, "cli") {
+					audit(target.GuildID, AuditEntry{Action: auditOptOut, UserID: userID, Result: "cli"})
+				}
+			}
+		}
+		log.Infof("Opted out %s. Run 'purge' to delete what was already archived", strings.Join(userIDs, ", "))
+	case "remove":
+		for _, target := range targets {
+			for _, userID := range userIDs {
+				if target.OptOuts.remove(userID) {
+					audit(target.GuildID, AuditEntry{Action: auditOptIn, UserID: userID, Result: "cli"})
+				}
+			}
+		}
+	case "list":
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(out, "GUILD\tUSER\tSINCE\tSOURCE")
+		for _, target := range targets {
+			for _, optOut := range target.OptOuts.list() {
+				since := ""
+				if !optOut.Time.IsZero() {
+					since = optOut.Time.Format(time.RFC3339)
+				}
+				fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", target.GuildID, optOut.UserID, since, optOut.Source)
+			}
+		}
+		out.Flush()
+	default:
+		log.Fatalf("Unknown optout action: %s. Valid actions are 'add', 'remove' or 'list'", action)
+	}
+}
+
+// purgeCommand deletes the already archived attachments of opted-out users from storage and drops them from the state file.
+// Every deletion is written to the audit log of the guild the file was posted in.
+// The state file is compacted afterwards, which drops lines a running archiver appends meanwhile, so stop the archiver first.
+func purgeCommand(args []string) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list the files that would be purged without deleting anything")
+	flags.Parse(args)
+	userIDs := flags.Args()
+	if len(userIDs) == 0 {
+		log.Fatalf("Usage: purge [-dry-run] <user id...>")
+	}
+
+	dg, targets := setup()
+	defer dg.Close()
+
+	targetsByGuild := map[string]*GuildTarget{}
+	for _, target := range targets {
+		targetsByGuild[target.GuildID] = target
+	}
+	storages := storagesByName(targets)
+
+	purged, failed := 0, 0
+	seenStates := map[*StateStore]bool{}
+	for _, target := range targets {
+		state := target.State
+		if seenStates[state] {
+			continue
+		}
+		seenStates[state] = true
+
+		records := state.records()
+		sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+		changed := false
+		for _, record := range records {
+			if record.AuthorID == "" || !slices.Contains(userIDs, record.AuthorID) {
+				continue
+			}
+
+			// Records keep the guild they were posted in, which may differ from the target sharing the state file
+			owner, ok := targetsByGuild[record.GuildID]
+			if !ok {
+				owner = target
+			}
+			if !owner.OptOuts.contains(record.AuthorID) {
+				log.Warnf("Not purging %s, user %s hasn't opted out in guild %s", record.Entity, record.AuthorID, owner.GuildID)
+				continue
+			}
+
+			if *dryRun {
+				log.Infof("Would purge %s (%s) from %s", recordPath(record), record.Entity, record.Destination)
+				purged++
+				continue
+			}
+
+			if err := purgeRecord(owner, state, record, storages[record.Destination]); err != nil {
+				log.Errorf("Error purging %s (%s): %v", recordPath(record), record.Entity, err)
+				failed++
+				continue
+			}
+			changed = true
+			purged++
+		}
+
+		// Drop the purged records' history from the state file as well
+		if changed {
+			if err := state.compact(); err != nil {
+				log.Errorf("Error compacting state file: %v", err)
+			}
+		}
+	}
+
+	if *dryRun {
+		log.Infof("Dry run: %d files would be purged", purged)
+		return
+	}
+	log.Infof("Purged %d files, %d failed", purged, failed)
+	if failed > 0 {
+		log.Warnf("Run the purge again to retry the failed files")
+	}
+}
+
+// storagesByName collects every storage instance in use under the destination name state records refer to it by
+func storagesByName(targets []*GuildTarget) map[string]StorageProvider {
+	byName := map[string]StorageProvider{}
+	if len(targets) == 0 {
+		return byName
+	}
+	for storage, name := range targets[0].Router.names {
+		byName[name] = storage
+	}
+	return byName
+}
+
+// purgeRecord deletes an archived file from storage and forgets it, along with the duplicates that referenced it.
+// The record is kept when deleting fails, so the purge can be run again.
+func purgeRecord(target *GuildTarget, state *StateStore, record *FileRecord, storage StorageProvider) error {
+	entry := AuditEntry{
+		Action:      auditPurgeFile,
+		UserID:      record.AuthorID,
+		GuildID:     record.GuildID,
+		Entity:      record.Entity,
+		Destination: record.Destination,
+		Path:        recordPath(record),
+	}
+
+	if record.Type == recordTypeFile {
+		if storage == nil {
+			err := fmt.Errorf("storage destination %s is not configured", record.Destination)
+			entry.Result, entry.Error = "failed", err.Error()
+			audit(target.GuildID, entry)
+			return err
+		}
+
+		err := deleteArchivedFile(storage, record)
+		if err != nil && !os.IsNotExist(err) {
+			entry.Result, entry.Error = "failed", err.Error()
+			audit(target.GuildID, entry)
+			return err
+		}
+		entry.Result = "deleted"
+		if err != nil {
+			entry.Result = "missing"
+		}
+		audit(target.GuildID, entry)
+
+		forgetFanOutProgress(state, storage, record.Entity)
+
+		// Other users' identical attachments only referenced this file, so they are archived again on the next run
+		for _, other := range state.records() {
+			if other.Type == recordTypeDuplicate && other.DuplicateOf == record.Entity && other.AuthorID != record.AuthorID {
+				state.forget(other.Entity)
+			}
+		}
+	}
+
+	state.forget(record.Entity)
+	audit(target.GuildID, AuditEntry{
+		Action:      auditPurgeState,
+		UserID:      record.AuthorID,
+		GuildID:     record.GuildID,
+		Entity:      record.Entity,
+		Destination: record.Destination,
+		Result:      "forgotten",
+	})
+	return nil
+}
+
+// deleteArchivedFile deletes the file a record was archived to.
+// Without a remote ID the file is looked up by path first, and only deleted if it matches the record,
+// since paths aren't unique on every provider.
+func deleteArchivedFile(storage StorageProvider, record *FileRecord) error {
+	if fanOut, ok := storage.(*FanOutStorage); ok {
+		// Remote IDs differ between destinations, so each one is looked up by path
+		byPath := *record
+		byPath.RemoteID = ""
+
+		deleted := 0
+		errs := []string{}
+		for _, member := range fanOut.members {
+			err := deleteArchivedFile(member.storage, &byPath)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", member.name, err))
+				continue
+			}
+			deleted++
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%s", strings.Join(errs, "; "))
+		}
+		if deleted == 0 {
+			return os.ErrNotExist
+		}
+		return nil
+	}
+
+	capabilities := storage.Capabilities()
+	if !capabilities.Delete {
+		return fmt.Errorf("%s doesn't support deleting files", storage.GetName())
+	}
+
+	ref := FileRef{Path: recordPath(record)}
+	if capabilities.StatByID && record.RemoteID != "" {
+		ref.ID = record.RemoteID
+		return storage.Delete(ref)
+	}
+
+	remote, err := storage.Stat(ref)
+	if err != nil {
+		return err
+	}
+	if !remoteMatchesRecord(remote, record) {
+		return fmt.Errorf("%s on %s doesn't match the archived file, delete it by hand", ref.Path, storage.GetName())
+	}
+	if capabilities.StatByID && remote.ID != "" {
+		ref.ID = remote.ID
+	}
+	return storage.Delete(ref)
+}
+
+// forgetFanOutProgress drops the per-destination progress a fan-out provider recorded for an entity
+func forgetFanOutProgress(state *StateStore, storage StorageProvider, entity string) {
+	if fanOut, ok := storage.(*FanOutStorage); ok {
+		for _, member := range fanOut.members {
+			state.forget(member.name + " " + entity)
+		}
+	}
+}
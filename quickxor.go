@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+)
+
+const (
+	quickXorWidthInBits = 160
+	quickXorShift       = 11
+)
+
+// quickXorHash computes OneDrive's QuickXorHash of data, base64 encoded as the API reports it.
+// See https://learn.microsoft.com/onedrive/developer/code-snippets/quickxorhash
+func quickXorHash(data []byte) string {
+	hasher := &quickXorHasher{}
+	hasher.Write(data)
+	return hasher.Sum()
+}
+
+// quickXorHasher computes a QuickXorHash over data written to it in pieces
+type quickXorHasher struct {
+	// Every byte quickXorWidthInBits apart lands on the same bit offset, so they are folded together as they arrive
+	folded [quickXorWidthInBits]byte
+	length uint64
+}
+
+// Write folds p into the hash. It never fails.
+func (q *quickXorHasher) Write(p []byte) (int, error) {
+	for _, b := range p {
+		q.folded[q.length%quickXorWidthInBits] ^= b
+		q.length++
+	}
+	return len(p), nil
+}
+
+// Sum returns the hash of everything written so far, base64 encoded
+func (q *quickXorHasher) Sum() string {
+	// 160 bits held in two 64 bit cells and one 32 bit cell
+	var cells [3]uint64
+	vectorArrayIndex := 0
+	vectorOffset := 0
+
+	iterations := min(q.length, quickXorWidthInBits)
+	for i := uint64(0); i < iterations; i++ {
+		isLastCell := vectorArrayIndex == len(cells)-1
+		bitsInVectorCell := 64
+		if isLastCell {
+			bitsInVectorCell = 32
+		}
+
+		xored := q.folded[i]
+
+		if vectorOffset <= bitsInVectorCell-8 {
+			cells[vectorArrayIndex] ^= uint64(xored) << uint(vectorOffset)
+		} else {
+			nextIndex := vectorArrayIndex + 1
+			if isLastCell {
+				nextIndex = 0
+			}
+			cells[vectorArrayIndex] ^= uint64(xored) << uint(vectorOffset)
+			cells[nextIndex] ^= uint64(xored) >> uint(bitsInVectorCell-vectorOffset)
+		}
+
+		vectorOffset += quickXorShift
+		for vectorOffset >= bitsInVectorCell {
+			if isLastCell {
+				vectorArrayIndex = 0
+			} else {
+				vectorArrayIndex++
+			}
+			vectorOffset -= bitsInVectorCell
+		}
+	}
+
+	hash := make([]byte, quickXorWidthInBits/8)
+	binary.LittleEndian.PutUint64(hash[0:8], cells[0])
+	binary.LittleEndian.PutUint64(hash[8:16], cells[1])
+	binary.LittleEndian.PutUint32(hash[16:20], uint32(cells[2]))
+
+	// The length is xored into the last 8 bytes
+	length := make([]byte, 8)
+	binary.LittleEndian.PutUint64(length, q.length)
+	for i, b := range length {
+		hash[len(hash)-8+i] ^= b
+	}
+
+	return base64.StdEncoding.EncodeToString(hash)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestQuickXorHash(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{name: "empty", input: []byte{}, want: "AAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+		{name: "one byte", input: []byte("a"), want: "YQAAAAAAAAAAAAAAAQAAAAAAAAA="},
+		{name: "longer than 160 bits", input: []byte("The quick brown fox jumps over the lazy dog"), want: "bMSlbysmxJL6S75XwfMcQZOpcr4="},
+		{name: "wraps around many times", input: bytes.Repeat(byteRange(), 4), want: "h7xr2dbCayZCQYR9KKhlwDuT4UI="},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := quickXorHash(test.input); got != test.want {
+				t.Errorf("quickXorHash() = %q, want %q", got, test.want)
+			}
+
+			// Writes split at odd offsets must hash the same as one write
+			var hasher quickXorHasher
+			for rest := test.input; len(rest) > 0; {
+				n := min(7, len(rest))
+				hasher.Write(rest[:n])
+				rest = rest[n:]
+			}
+			if got := hasher.Sum(); got != test.want {
+				t.Errorf("quickXorHasher.Sum() after split writes = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// byteRange returns every byte value once, in order
+func byteRange() []byte {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
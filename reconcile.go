@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reconcileSource is a set of state records stored in one storage instance.
+// Fan-out members track their own progress under prefix, which is "" for plain providers.
+type reconcileSource struct {
+	destination string
+	prefix      string
+}
+
+// stateRecord is a file record along with the state store it was read from
+type stateRecord struct {
+	state  *StateStore
+	record *FileRecord
+}
+
+// reconcileReport lists the differences between the state store and one storage instance
+type reconcileReport struct {
+	missing    []stateRecord
+	mismatched []stateRecord
+	extra      []*RemoteFile
+}
+
+// reconcileCommand compares every archived file in the state stores against what the storage destinations actually hold.
+// With -clear-missing, files that are gone from storage are forgotten so the next run archives them again.
+func reconcileCommand(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	clearMissing := flags.Bool("clear-missing", false, "forget files missing from storage so the next run archives them again")
+	flags.Parse(args)
+
+	dg, targets := setup()
+	defer dg.Close()
+
+	records := []stateRecord{}
+	seenStates := map[*StateStore]bool{}
+	for _, target := range targets {
+		if seenStates[target.State] {
+			continue
+		}
+		seenStates[target.State] = true
+		for _, record := range target.State.records() {
+			if record.Type == recordTypeFile {
+				records = append(records, stateRecord{state: target.State, record: record})
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].record.Time.Before(records[j].record.Time) })
+
+	storages, sources := reconcileStorages(targets)
+	for _, storage := range storages {
+		name := targets[0].Router.destinationName(storage)
+		report, err := reconcileStorage(storage, sources[storage], records)
+		if err != nil {
+			log.Errorf("Error reconciling %s: %v", name, err)
+			continue
+		}
+
+		for _, missing := range report.missing {
+			log.Warnf("Missing from %s: %s (%s)", name, recordPath(missing.record), missing.record.Entity)
+		}
+		for _, mismatched := range report.mismatched {
+			log.Warnf("Mismatched on %s: %s (%s)", name, recordPath(mismatched.record), mismatched.record.Entity)
+		}
+		for _, extra := range report.extra {
+			log.Warnf("Not in state, found on %s: %s", name, extra.Path)
+		}
+		log.Infof("Reconciled %s: %d missing, %d mismatched, %d extra", name, len(report.missing), len(report.mismatched), len(report.extra))
+
+		if *clearMissing {
+			for _, missing := range report.missing {
+				forgetRecord(missing, sources[storage])
+			}
+			log.Infof("Cleared %d missing files from state, they will be archived again next run", len(report.missing))
+		}
+	}
+}
+
+// reconcileStorages collects every distinct storage instance in use, along with the state records each one holds.
+// A fan-out destination's records are expected in every one of its members.
+func reconcileStorages(targets []*GuildTarget) ([]StorageProvider, map[StorageProvider][]reconcileSource) {
+	providers := []StorageProvider{}
+	for _, target := range targets {
+		providers = append(providers, target.Storage)
+	}
+	if len(targets) > 0 {
+		names := []string{}
+		for name := range targets[0].Router.destinations {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			providers = append(providers, targets[0].Router.destinations[name])
+		}
+	}
+
+	storages := []StorageProvider{}
+	sources := map[StorageProvider][]reconcileSource{}
+	add := func(storage StorageProvider, source reconcileSource) {
+		if slices.Contains(sources[storage], source) {
+			return
+		}
+		if _, ok := sources[storage]; !ok {
+			storages = append(storages, storage)
+		}
+		sources[storage] = append(sources[storage], source)
+	}
+
+	for _, storage := range providers {
+		destination := targets[0].Router.destinationName(storage)
+		fanOut, ok := storage.(*FanOutStorage)
+		if !ok {
+			add(storage, reconcileSource{destination: destination})
+			continue
+		}
+		for _, member := range fanOut.members {
+			add(member.storage, reconcileSource{destination: destination, prefix: member.name + " "})
+		}
+	}
+
+	return storages, sources
+}
+
+// reconcileStorage lists a storage instance and matches its files against the records it should hold.
+// Records are matched by remote ID when one was recorded, and otherwise by path.
+func reconcileStorage(storage StorageProvider, sources []reconcileSource, records []stateRecord) (*reconcileReport, error) {
+	report := &reconcileReport{}
+	if len(sources) == 0 {
+		return report, nil
+	}
+
+	log.Infof("Listing %s", storage.GetName())
+	remoteFiles, err := listAll(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[string]*RemoteFile{}
+	byPath := map[string][]*RemoteFile{}
+	for _, remote := range remoteFiles {
+		if remote.ID != "" {
+			byID[remote.ID] = remote
+		}
+		byPath[remote.Path] = append(byPath[remote.Path], remote)
+	}
+
+	claimed := map[*RemoteFile]bool{}
+	for _, entry := range records {
+		if !slices.ContainsFunc(sources, func(source reconcileSource) bool { return source.destination == entry.record.Destination }) {
+			continue
+		}
+
+		remote, ok := byID[entry.record.RemoteID]
+		if !ok || entry.record.RemoteID == "" || claimed[remote] {
+			remote = claimByPath(byPath[recordPath(entry.record)], entry.record, claimed)
+		}
+		if remote == nil {
+			report.missing = append(report.missing, entry)
+			continue
+		}
+
+		claimed[remote] = true
+		if !remoteMatchesRecord(remote, entry.record) {
+			report.mismatched = append(report.mismatched, entry)
+		}
+	}
+
+	for _, remote := range remoteFiles {
+		if !claimed[remote] {
+			report.extra = append(report.extra, remote)
+		}
+	}
+
+	return report, nil
+}
+
+// claimByPath picks an unclaimed file for a record among the files stored at its path, preferring one with matching content
+func claimByPath(candidates []*RemoteFile, record *FileRecord, claimed map[*RemoteFile]bool) *RemoteFile {
+	var fallback *RemoteFile
+	for _, remote := range candidates {
+		if claimed[remote] {
+			continue
+		}
+		if remoteMatchesRecord(remote, record) {
+			return remote
+		}
+		if fallback == nil {
+			fallback = remote
+		}
+	}
+	return fallback
+}
+
+// remoteMatchesRecord compares the size and sha256 of a stored file against the record, where both sides know them
+func remoteMatchesRecord(remote *RemoteFile, record *FileRecord) bool {
+	if remote.Size > 0 && record.Size > 0 && remote.Size != int64(record.Size) {
+		return false
+	}
+	if remote.SHA256 != "" && record.SHA256 != "" && !strings.EqualFold(remote.SHA256, record.SHA256) {
+		return false
+	}
+	return true
+}
+
+// recordPath returns the path a record was uploaded under. Records written before paths were kept used the attachment filename.
+func recordPath(record *FileRecord) string {
+	if record.Path != "" {
+		return record.Path
+	}
+	return record.Filename
+}
+
+// forgetRecord drops a missing file from its state store, including the fan-out progress of the member it is missing from
+func forgetRecord(entry stateRecord, sources []reconcileSource) {
+	entry.state.forget(entry.record.Entity)
+	for _, source := range sources {
+		if source.destination == entry.record.Destination && source.prefix != "" {
+			entry.state.forget(source.prefix + entry.record.Entity)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// reportTopErrors is how many error classes a run report lists
+const reportTopErrors = 5
+
+// runReport summarises a finished run over a guild. It is the body posted to generic JSON webhooks.
+type runReport struct {
+	GuildID         string        `json:"guild_id"`
+	GuildName       string        `json:"guild_name,omitempty"`
+	Started         time.Time     `json:"started"`
+	Finished        time.Time     `json:"finished"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Channels        int           `json:"channels_scanned"`
+	Messages        int           `json:"messages_checked"`
+	MessagesSkipped int           `json:"messages_skipped"`
+	Uploaded        int           `json:"files_uploaded"`
+	FilesSkipped    int           `json:"files_skipped"`
+	Failed          int           `json:"files_failed"`
+	Bytes           int64         `json:"bytes_uploaded"`
+	TopErrors       []reportError `json:"top_errors"`
+}
+
+// reportError is one of the most frequent error classes of a run
+type reportError struct {
+	Class   string `json:"class"`
+	Count   int    `json:"count"`
+	Example string `json:"example"`
+}
+
+// newRunReport builds the report of a guild's run from its status
+func newRunReport(dg *discordgo.Session, guildID string, status runStatus) *runReport {
+	report := &runReport{
+		GuildID:         guildID,
+		Started:         status.Started,
+		Finished:        status.Finished,
+		DurationSeconds: status.Finished.Sub(status.Started).Seconds(),
+		Channels:        status.Channels,
+		Messages:        status.Messages,
+		MessagesSkipped: status.Skipped,
+		Uploaded:        status.Uploaded,
+		FilesSkipped:    status.Duplicates,
+		Failed:          status.Failed,
+		Bytes:           status.Bytes,
+		TopErrors:       []reportError{},
+	}
+	if guild, err := dg.State.Guild(guildID); err == nil {
+		report.GuildName = guild.Name
+	}
+
+	for class, count := range status.ErrorClasses {
+		report.TopErrors = append(report.TopErrors, reportError{Class: class, Count: count.Count, Example: count.Example})
+	}
+	sort.Slice(report.TopErrors, func(i, j int) bool {
+		if report.TopErrors[i].Count != report.TopErrors[j].Count {
+			return report.TopErrors[i].Count > report.TopErrors[j].Count
+		}
+		return report.TopErrors[i].Class < report.TopErrors[j].Class
+	})
+	if len(report.TopErrors) > reportTopErrors {
+		report.TopErrors = report.TopErrors[:reportTopErrors]
+	}
+
+	return report
+}
+
+// sendRunReport delivers the report of a guild's latest run to every configured destination:
+// a channel through the bot session, a Discord webhook, and a generic JSON webhook.
+// Delivery failures are logged and don't fail the run.
+func sendRunReport(dg *discordgo.Session, guildID string) {
+	channelID := guildEnv(guildID, "REPORT_CHANNEL_ID")
+	discordWebhook := guildEnv(guildID, "REPORT_DISCORD_WEBHOOK_URL")
+	jsonWebhook := guildEnv(guildID, "REPORT_WEBHOOK_URL")
+	if channelID == "" && discordWebhook == "" && jsonWebhook == "" {
+		return
+	}
+
+	status, ok := guildRunStatus(guildID)
+	if !ok {
+		return
+	}
+	report := newRunReport(dg, guildID, status)
+
+	if channelID != "" {
+		if _, err := dg.ChannelMessageSendEmbed(channelID, report.embed()); err != nil {
+			log.Errorf("Error posting run report to channel %s: %v", channelID, err)
+		}
+	}
+	if discordWebhook != "" {
+		if err := postJSON(discordWebhook, &discordgo.WebhookParams{Embeds: []*discordgo.MessageEmbed{report.embed()}}); err != nil {
+			log.Errorf("Error posting run report to Discord webhook: %v", err)
+		}
+	}
+	if jsonWebhook != "" {
+		if err := postJSON(jsonWebhook, report); err != nil {
+			log.Errorf("Error posting run report to webhook: %v", err)
+		}
+	}
+}
+
+// embed renders the report as a Discord embed
+func (r *runReport) embed() *discordgo.MessageEmbed {
+	name := r.GuildName
+	if name == "" {
+		name = r.GuildID
+	}
+
+	color := 0x2ecc71 // green
+	if r.Failed > 0 {
+		color = 0xe67e22 // orange
+	}
+
+	field := func(name string, value any) *discordgo.MessageEmbedField {
+		return &discordgo.MessageEmbedField{Name: name, Value: fmt.Sprint(value), Inline: true}
+	}
+	embed := &discordgo.MessageEmbed{
+		Title:     fmt.Sprintf("Archive run for %s", name),
+		Color:     color,
+		Timestamp: r.Finished.Format(time.RFC3339),
+		Fields: []*discordgo.MessageEmbedField{
+			field("Duration", time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Second)),
+			field("Channels scanned", r.Channels),
+			field("Messages checked", r.Messages),
+			field("Messages skipped", r.MessagesSkipped),
+			field("Files uploaded", r.Uploaded),
+			field("Files skipped", r.FilesSkipped),
+			field("Bytes uploaded", formatBytes(r.Bytes)),
+			field("Failures", r.Failed),
+		},
+	}
+
+	if len(r.TopErrors) > 0 {
+		lines := []string{}
+		for _, e := range r.TopErrors {
+			example := e.Example
+			if len(example) > 150 {
+				example = strings.ToValidUTF8(example[:147], "") + "..."
+			}
+			lines = append(lines, fmt.Sprintf("**%s** ×%d: %s", e.Class, e.Count, example))
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Top errors", Value: strings.Join(lines, "\n")})
+	}
+
+	return embed
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. 1.5 MiB
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < 4 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[unit-1])
+}
+
+// postJSON posts body as JSON to a webhook, treating any status other than 2xx as an error.
+// Webhook URLs carry their secret, so errors never include the URL.
+func postJSON(webhookURL string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("error encoding webhook body: %v", err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("error posting to webhook: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook answered %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Error classes of failed attachments
+const (
+	failureHTTPStatus   = "http_status"   // the CDN answered with an error status
+	failureDownload     = "download"      // the download itself failed
+	failureSizeMismatch = "size_mismatch" // fewer or more bytes arrived than Discord reported
+	failureMimeMismatch = "mime_mismatch" // the content isn't the kind of file Discord reported
+	failureUpload       = "upload"        // the storage provider rejected or couldn't verify the upload
+	failureDiscord      = "discord"       // the message or attachment could no longer be fetched for a retry
+)
+
+// FailedJob is an attachment that failed to archive, waiting to be retried.
+// Once it has used up its attempts it stays in the queue as a dead letter until it is retried or purged by hand.
+type FailedJob struct {
+	AttachmentID string    `json:"attachment_id"`
+	GuildID      string    `json:"guild_id"`
+	ChannelID    string    `json:"channel_id"`
+	MessageID    string    `json:"message_id"`
+	Filename     string    `json:"filename"`
+	ErrorClass   string    `json:"error_class"`
+	Error        string    `json:"error"`
+	Status       int       `json:"status,omitempty"`
+	Attempts     int       `json:"attempts"`
+	FirstFailure time.Time `json:"first_failure"`
+	LastFailure  time.Time `json:"last_failure"`
+	NextRetry    time.Time `json:"next_retry"`
+	Dead         bool      `json:"dead,omitempty"`
+}
+
+// RetryQueue keeps failed attachments in a JSON lines file next to the state file.
+// The queue is small, so the whole file is rewritten on every change.
+type RetryQueue struct {
+	path string
+	jobs map[string]*FailedJob // attachment ID -> job
+	mu   sync.Mutex
+}
+
+// openRetryQueue loads the failed attachments previously recorded at path
+func openRetryQueue(path string) *RetryQueue {
+	jobs, err := readRetryJobs(path)
+	if err != nil {
+		log.Fatalf("Error opening retry queue file: %v", err)
+	}
+	return &RetryQueue{path: path, jobs: jobs}
+}
+
+// readRetryJobs reads the failed attachments recorded at path. A missing file holds none.
+func readRetryJobs(path string) (map[string]*FailedJob, error) {
+	jobs := map[string]*FailedJob{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return jobs, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		job := &FailedJob{}
+		if err := json.Unmarshal([]byte(line), job); err != nil {
+			log.Errorf("Skipping malformed retry queue entry %q: %v", line, err)
+			continue
+		}
+		jobs[job.AttachmentID] = job
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Error reading retry queue file: %v", err)
+	}
+
+	return jobs, nil
+}
+
+// reload reads the queue file again, picking up changes other processes made since it was loaded,
+// such as the deadletters command run while the archiver is running. Callers hold q.mu.
+func (q *RetryQueue) reload() {
+	jobs, err := readRetryJobs(q.path)
+	if err != nil {
+		log.Errorf("Error reloading retry queue file, keeping the jobs loaded earlier: %v", err)
+		return
+	}
+	q.jobs = jobs
+}
+
+// retryQueuePath returns the retry queue file for a guild, next to its state file unless RETRY_QUEUE_FILE is set
+func retryQueuePath(guildID string) string {
+	if path := guildEnv(guildID, "RETRY_QUEUE_FILE"); path != "" {
+		return path
+	}
+	return guildEnv(guildID, "STATE_FILE") + ".retry"
+}
+
+// retryBackoff returns how long to wait before the next attempt of a job that has failed attempts times.
+// The wait starts at RETRY_BACKOFF_SECONDS (default 300) and doubles with every attempt, up to a day.
+func retryBackoff(guildID string, attempts int) time.Duration {
+	backoff := 300 * time.Second
+	if guildEnv(guildID, "RETRY_BACKOFF_SECONDS") != "" {
+		seconds, err := strconv.Atoi(guildEnv(guildID, "RETRY_BACKOFF_SECONDS"))
+		if err != nil {
+			log.Errorf("Invalid RETRY_BACKOFF_SECONDS: %v", err)
+		} else {
+			backoff = time.Duration(seconds) * time.Second
+		}
+	}
+
+	for i := 1; i < attempts && backoff < 24*time.Hour; i++ {
+		backoff *= 2
+	}
+	return min(backoff, 24*time.Hour)
+}
+
+// retryMaxAttempts returns RETRY_MAX_ATTEMPTS (default 5), after which a failed job becomes a dead letter
+func retryMaxAttempts(guildID string) int {
+	if guildEnv(guildID, "RETRY_MAX_ATTEMPTS") != "" {
+		attempts, err := strconv.Atoi(guildEnv(guildID, "RETRY_MAX_ATTEMPTS"))
+		if err == nil {
+			return attempts
+		}
+		log.Errorf("Invalid RETRY_MAX_ATTEMPTS: %v", err)
+	}
+	return 5
+}
+
+// fail records a failed attempt at archiving a job's attachment and schedules the next one
+func (q *RetryQueue) fail(job *attachmentJob, class string, status int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reload()
+
+	now := time.Now()
+	failed, ok := q.jobs[job.Attachment.ID]
+	if !ok {
+		failed = &FailedJob{
+			AttachmentID: job.Attachment.ID,
+			GuildID:      job.Target.GuildID,
+			ChannelID:    job.Channel.ID,
+			MessageID:    job.Message.ID,
+			Filename:     job.Attachment.Filename,
+			FirstFailure: now,
+		}
+		q.jobs[failed.AttachmentID] = failed
+	}
+
+	failed.ErrorClass = class
+	failed.Error = err.Error()
+	failed.Status = status
+	failed.Attempts++
+	failed.LastFailure = now
+	failed.NextRetry = now.Add(retryBackoff(failed.GuildID, failed.Attempts))
+	if failed.Attempts >= retryMaxAttempts(failed.GuildID) {
+		failed.Dead = true
+		log.Warnf("Giving up on %s after %d attempts, it is now a dead letter: %v", failed.Filename, failed.Attempts, err)
+	}
+
+	q.save()
+	countFile(failed.GuildID, failed.ChannelID, fileFailed)
+	countFailure(failed.GuildID, class, failed.Error)
+}
+
+// succeed drops an attachment from the queue once it has been archived
+func (q *RetryQueue) succeed(attachmentID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reload()
+
+	if _, ok := q.jobs[attachmentID]; ok {
+		delete(q.jobs, attachmentID)
+		q.save()
+	}
+}
+
+// purge drops jobs from the queue without retrying them
+func (q *RetryQueue) purge(jobs []*FailedJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reload()
+
+	for _, job := range jobs {
+		delete(q.jobs, job.AttachmentID)
+	}
+	q.save()
+}
+
+// list returns the queued jobs of a guild, oldest failure first. Without dead only jobs still being retried are returned.
+func (q *RetryQueue) list(guildID string, dead bool) []*FailedJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := []*FailedJob{}
+	for _, job := range q.jobs {
+		if job.GuildID == guildID && job.Dead == dead {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].FirstFailure.Before(jobs[j].FirstFailure) })
+	return jobs
+}
+
+// due returns the jobs of a guild whose next retry has come
+func (q *RetryQueue) due(guildID string, now time.Time) []*FailedJob {
+	jobs := []*FailedJob{}
+	for _, job := range q.list(guildID, false) {
+		if !job.NextRetry.After(now) {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// holds returns an attachment's queued job when the queue keeps it from being downloaded:
+// it is a dead letter, or its next retry hasn't come yet
+func (q *RetryQueue) holds(attachmentID string, now time.Time) (*FailedJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[attachmentID]
+	if !ok || (!job.Dead && !job.NextRetry.After(now)) {
+		return nil, false
+	}
+	return job, true
+}
+
+// save atomically rewrites the queue file. Callers hold q.mu.
+func (q *RetryQueue) save() {
+	var lines strings.Builder
+	for _, job := range q.jobs {
+		line, err := json.Marshal(job)
+		if err != nil {
+			log.Errorf("Error encoding retry queue entry for %s: %v", job.AttachmentID, err)
+			continue
+		}
+		lines.Write(line)
+		lines.WriteString("\n")
+	}
+
+	if err := writeFileAtomic(q.path, lines.String()); err != nil {
+		log.Errorf("Error writing retry queue file: %v", err)
+	}
+}
+
+// retryFailedJobs retries every failed attachment of a guild whose backoff has elapsed
+func retryFailedJobs(dg *discordgo.Session, target *GuildTarget) {
+	jobs := target.Retries.due(target.GuildID, time.Now())
+	if len(jobs) == 0 {
+		return
+	}
+
+	log.Infof("Retrying %d failed attachments in guild %s", len(jobs), target.GuildID)
+	for _, failed := range jobs {
+		retryFailedJob(dg, target, failed)
+	}
+}
+
+// retryFailedJob fetches a failed attachment's message again, for a fresh URL, and downloads it
+func retryFailedJob(dg *discordgo.Session, target *GuildTarget, failed *FailedJob) {
+	channel, err := dg.Channel(failed.ChannelID)
+	if err != nil {
+		log.Errorf("Error fetching channel %s to retry %s: %v", failed.ChannelID, failed.Filename, err)
+		target.Retries.fail(failedJobStub(target, failed), failureDiscord, 0, err)
+		return
+	}
+
+	message, err := dg.ChannelMessage(failed.ChannelID, failed.MessageID)
+	if err != nil {
+		log.Errorf("Error fetching message %s to retry %s: %v", failed.MessageID, failed.Filename, err)
+		target.Retries.fail(failedJobStub(target, failed), failureDiscord, 0, err)
+		return
+	}
+
+	for _, attachment := range message.Attachments {
+		if attachment.ID != failed.AttachmentID {
+			continue
+		}
+
+		job := &attachmentJob{
+			Session:    dg,
+			Target:     target,
+			Channel:    channel,
+			Message:    message,
+			Attachment: attachment,
+		}
+		if (target.Router.needsRoles() || target.Selection.needsRoles()) && message.Author != nil {
+			job.Roles = memberRoles(dg, target.GuildID, message.Author.ID)
+		}
+
+		// The message may no longer be selected, e.g. after a reaction was removed
+		if selected, reason := target.selects(message, job.Roles); !selected {
+			log.Infof("Dropping %s from the retry queue, its message is no longer selected by %s", failed.Filename, reason)
+			target.Retries.purge([]*FailedJob{failed})
+			countFile(target.GuildID, failed.ChannelID, fileFiltered)
+			return
+		}
+
+		storage := target.Router.Route(job)
+		log.Debugf("Retrying %s (attempt %d) to %s", attachment.Filename, failed.Attempts+1, storage.GetName())
+		download(job, storage)
+		return
+	}
+
+	err = fmt.Errorf("attachment %s is no longer on message %s", failed.AttachmentID, failed.MessageID)
+	log.Errorf("Error retrying %s: %v", failed.Filename, err)
+	target.Retries.fail(failedJobStub(target, failed), failureDiscord, 0, err)
+}
+
+// failedJobStub rebuilds enough of an attachment job to record another failed attempt
+func failedJobStub(target *GuildTarget, failed *FailedJob) *attachmentJob {
+	return &attachmentJob{
+		Target:     target,
+		Channel:    &discordgo.Channel{ID: failed.ChannelID},
+		Message:    &discordgo.Message{ID: failed.MessageID},
+		Attachment: &discordgo.MessageAttachment{ID: failed.AttachmentID, Filename: failed.Filename},
+	}
+}
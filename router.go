@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// attachmentJob describes a single attachment along with the message and channel it was posted in
+type attachmentJob struct {
+	Session    *discordgo.Session
+	Target     *GuildTarget
+	Channel    *discordgo.Channel
+	Message    *discordgo.Message
+	Attachment *discordgo.MessageAttachment
+	Roles      []string
+}
+
+// RoutingRule sends attachments matching every populated field to a named storage destination.
+// Empty fields match anything.
+type RoutingRule struct {
+	Name        string   `json:"name"`
+	Guilds      []string `json:"guilds"`
+	Channels    []string `json:"channels"`
+	Categories  []string `json:"categories"`
+	Authors     []string `json:"authors"`
+	Roles       []string `json:"roles"`
+	MimeTypes   []string `json:"mime_types"`
+	MinSize     int      `json:"min_size"`
+	MaxSize     int      `json:"max_size"`
+	Destination string   `json:"destination"`
+}
+
+// Router picks the storage destination for each attachment from an ordered list of rules
+type Router struct {
+	Rules        []RoutingRule `json:"rules"`
+	Default      string        `json:"default"`
+	destinations map[string]StorageProvider
+	names        map[StorageProvider]string // storage instance -> destination name recorded in the state file
+}
+
+// destinationEnv returns the DEST_<name>_<key> setting for a named destination, falling back to the global <key>
+func destinationEnv(name, key string) string {
+	if value := os.Getenv("DEST_" + strings.ToUpper(name) + "_" + key); value != "" {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// initStorageRegistry builds a storage provider for every destination listed in STORAGE_DESTINATIONS.
+// Fan-out destinations are built last so they can reference any other destination.
+func initStorageRegistry() map[string]StorageProvider {
+	registry := map[string]StorageProvider{}
+	fanOuts := []string{}
+
+	for _, name := range strings.Split(os.Getenv("STORAGE_DESTINATIONS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := registry[name]; ok || slices.Contains(fanOuts, name) {
+			log.Fatalf("Storage destination %s is defined more than once", name)
+		}
+
+		env := func(key string) string { return destinationEnv(name, key) }
+		if env("STORAGE_PROVIDER") == "fanout" {
+			fanOuts = append(fanOuts, name)
+			continue
+		}
+
+		log.Infof("Initializing storage destination %s", name)
+		registry[name] = initStorage(env, registry)
+	}
+
+	for _, name := range fanOuts {
+		log.Infof("Initializing storage destination %s", name)
+		registry[name] = initStorage(func(key string) string { return destinationEnv(name, key) }, registry)
+	}
+
+	return registry
+}
+
+// initRouter loads the routing rules in ROUTING_RULES_FILE and validates them against the storage registry.
+// Without a rules file every attachment goes to its guild's storage provider.
+func initRouter(destinations map[string]StorageProvider) *Router {
+	router := &Router{destinations: destinations, names: map[StorageProvider]string{}}
+	for name, storage := range destinations {
+		router.names[storage] = name
+	}
+
+	rulesFile := os.Getenv("ROUTING_RULES_FILE")
+	if rulesFile == "" {
+		return router
+	}
+
+	data, err := os.ReadFile(rulesFile)
+	if err != nil {
+		log.Fatalf("Error reading routing rules file: %v", err)
+	}
+	if err := json.Unmarshal(data, router); err != nil {
+		log.Fatalf("Error parsing routing rules file: %v", err)
+	}
+
+	for i, rule := range router.Rules {
+		if _, ok := destinations[rule.Destination]; !ok {
+			log.Fatalf("Routing rule %d (%s) references unknown storage destination %q", i, rule.Name, rule.Destination)
+		}
+	}
+	if _, ok := destinations[router.Default]; router.Default != "" && !ok {
+		log.Fatalf("Default routing destination %q is not a known storage destination", router.Default)
+	}
+
+	log.Infof("Loaded %d routing rules", len(router.Rules))
+	return router
+}
+
+// destinationName returns the name state records refer to a storage instance by: its STORAGE_DESTINATIONS name,
+// or "guild:default" and "guild:<guild id>" for guild storage providers
+func (r *Router) destinationName(storage StorageProvider) string {
+	if name, ok := r.names[storage]; ok {
+		return name
+	}
+	return storage.GetName()
+}
+
+// needsRoles reports whether any rule matches on member roles, which costs a member lookup per author
+func (r *Router) needsRoles() bool {
+	for _, rule := range r.Rules {
+		if len(rule.Roles) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Route returns the storage provider an attachment should be uploaded to
+func (r *Router) Route(job *attachmentJob) StorageProvider {
+	for _, rule := range r.Rules {
+		if rule.matches(job) {
+			log.Debugf("Attachment %s matched routing rule %s", job.Attachment.ID, rule.Name)
+			return r.destinations[rule.Destination]
+		}
+	}
+
+	if r.Default != "" {
+		return r.destinations[r.Default]
+	}
+	return job.Target.Storage
+}
+
+// matches reports whether every populated field of the rule matches the attachment
+func (rule *RoutingRule) matches(job *attachmentJob) bool {
+	if len(rule.Guilds) > 0 && !slices.Contains(rule.Guilds, job.Target.GuildID) {
+		return false
+	}
+	if len(rule.Channels) > 0 && !slices.Contains(rule.Channels, job.Channel.ID) {
+		return false
+	}
+	if len(rule.Categories) > 0 && !slices.Contains(rule.Categories, job.Channel.ParentID) {
+		return false
+	}
+	if len(rule.Authors) > 0 && (job.Message.Author == nil || !slices.Contains(rule.Authors, job.Message.Author.ID)) {
+		return false
+	}
+	if len(rule.Roles) > 0 && !slices.ContainsFunc(job.Roles, func(role string) bool { return slices.Contains(rule.Roles, role) }) {
+		return false
+	}
+	if len(rule.MimeTypes) > 0 && !matchesMimeType(rule.MimeTypes, job.Attachment.ContentType) {
+		return false
+	}
+	if rule.MinSize > 0 && job.Attachment.Size < rule.MinSize {
+		return false
+	}
+	if rule.MaxSize > 0 && job.Attachment.Size > rule.MaxSize {
+		return false
+	}
+	return true
+}
+
+// matchesMimeType matches a content type against patterns such as "image/png" or "video/*"
+func matchesMimeType(patterns []string, contentType string) bool {
+	contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			prefix := strings.TrimSuffix(pattern, "*")
+			if len(contentType) >= len(prefix) && strings.EqualFold(contentType[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(pattern, contentType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretStore persists sensitive blobs such as OAuth tokens.
+// Load returns an error satisfying os.IsNotExist when nothing has been saved under name.
+type SecretStore interface {
+	Load(name string) ([]byte, error)
+	Save(name string, data []byte) error
+}
+
+// tokenStore holds the OAuth tokens of every storage provider
+var tokenStore SecretStore = &FileSecretStore{}
+
+// initTokenStore selects the secret store for OAuth tokens from TOKEN_STORE
+func initTokenStore() {
+	switch os.Getenv("TOKEN_STORE") {
+	case "", "file":
+		tokenStore = &FileSecretStore{}
+	case "encrypted":
+		key, passphrase, err := loadEncryptionKey()
+		if err != nil {
+			log.Fatalf("Error loading token encryption key: %v", err)
+		}
+		if passphrase != "" {
+			tokenStore = NewPassphraseSecretStore(passphrase)
+		} else {
+			tokenStore = NewEncryptedFileSecretStore(key)
+		}
+	case "kubernetes":
+		store, err := NewKubernetesSecretStore(os.Getenv("TOKEN_STORE_SECRET_NAME"))
+		if err != nil {
+			log.Fatalf("Error initializing Kubernetes token store: %v", err)
+		}
+		tokenStore = store
+	default:
+		log.Fatalf("Unknown TOKEN_STORE: %s. Valid options are 'file', 'encrypted' or 'kubernetes'", os.Getenv("TOKEN_STORE"))
+	}
+}
+
+// FileSecretStore keeps each secret in a plaintext file readable only by its owner
+type FileSecretStore struct{}
+
+// Load reads the file at name
+func (f *FileSecretStore) Load(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// Save atomically replaces the file at name, so a crash mid-write never leaves a truncated file
+func (f *FileSecretStore) Save(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error restricting file permissions: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// encryptedPrefix marks a file written by EncryptedFileSecretStore with a key
+const encryptedPrefix = "dpr-aes-gcm:v1:"
+
+// passphrasePrefix marks a file written by EncryptedFileSecretStore with a passphrase.
+// The base64 scrypt salt follows, then a colon and the sealed secret.
+const passphrasePrefix = "dpr-aes-gcm:v2:"
+
+// scrypt cost parameters for deriving a key from a passphrase
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// EncryptedFileSecretStore keeps each secret in a file encrypted with AES-256-GCM
+type EncryptedFileSecretStore struct {
+	files FileSecretStore
+	aead  cipher.AEAD // nil with a passphrase
+
+	// With a passphrase every file stores the salt its key was derived with
+	passphrase string
+	mu         sync.Mutex
+	salt       []byte                 // salt of the files this process saves
+	derived    map[string]cipher.AEAD // salt -> cipher, since scrypt is deliberately slow
+}
+
+// NewEncryptedFileSecretStore creates an encrypted file store from a 32 byte key
+func NewEncryptedFileSecretStore(key []byte) *EncryptedFileSecretStore {
+	aead, err := newGCM(key)
+	if err != nil {
+		log.Fatalf("Error creating token cipher: %v", err)
+	}
+	return &EncryptedFileSecretStore{aead: aead}
+}
+
+// NewPassphraseSecretStore creates an encrypted file store whose keys are derived from a passphrase with scrypt
+func NewPassphraseSecretStore(passphrase string) *EncryptedFileSecretStore {
+	return &EncryptedFileSecretStore{passphrase: passphrase, derived: map[string]cipher.AEAD{}}
+}
+
+// newGCM creates an AES-256-GCM cipher from a 32 byte key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadEncryptionKey reads the key from TOKEN_ENCRYPTION_KEY or the file named by TOKEN_ENCRYPTION_KEY_FILE.
+// A base64 encoded 32 byte key is returned as key; any other value is returned as a passphrase.
+func loadEncryptionKey() (key []byte, passphrase string, err error) {
+	secret := os.Getenv("TOKEN_ENCRYPTION_KEY")
+	if keyFile := os.Getenv("TOKEN_ENCRYPTION_KEY_FILE"); keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading key file: %v", err)
+		}
+		secret = string(data)
+	}
+
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return nil, "", fmt.Errorf("set TOKEN_ENCRYPTION_KEY or TOKEN_ENCRYPTION_KEY_FILE")
+	}
+
+	if key, err := base64.StdEncoding.DecodeString(secret); err == nil && len(key) == 32 {
+		return key, "", nil
+	}
+	return nil, secret, nil
+}
+
+// saltedCipher returns the cipher for the passphrase with salt, deriving its key on first use
+func (e *EncryptedFileSecretStore) saltedCipher(salt []byte) (cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if aead, ok := e.derived[string(salt)]; ok {
+		return aead, nil
+	}
+	key, err := scrypt.Key([]byte(e.passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key from passphrase: %v", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	e.derived[string(salt)] = aead
+	return aead, nil
+}
+
+// Load reads and decrypts the file at name.
+// Plaintext files written before encryption was enabled are still read, and get encrypted the next time they are saved.
+func (e *EncryptedFileSecretStore) Load(name string) ([]byte, error) {
+	data, err := e.files.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	aead := e.aead
+	var encoded string
+	switch {
+	case bytes.HasPrefix(data, []byte(passphrasePrefix)):
+		if e.passphrase == "" {
+			return nil, fmt.Errorf("secret %s was encrypted with a passphrase, set TOKEN_ENCRYPTION_KEY to it", name)
+		}
+		saltEncoded, sealedEncoded, ok := strings.Cut(string(data[len(passphrasePrefix):]), ":")
+		if !ok {
+			return nil, fmt.Errorf("encrypted secret %s has no salt", name)
+		}
+		salt, err := base64.StdEncoding.DecodeString(saltEncoded)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding salt of encrypted secret %s: %v", name, err)
+		}
+		if aead, err = e.saltedCipher(salt); err != nil {
+			return nil, err
+		}
+		encoded = sealedEncoded
+	case bytes.HasPrefix(data, []byte(encryptedPrefix)):
+		if e.passphrase != "" {
+			return nil, fmt.Errorf("secret %s was encrypted with a key, not a passphrase, set TOKEN_ENCRYPTION_KEY to the base64 key", name)
+		}
+		encoded = string(data[len(encryptedPrefix):])
+	default:
+		log.Warnf("Secret %s is not encrypted yet, it will be encrypted when next saved", name)
+		return data, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding encrypted secret %s: %v", name, err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted secret %s is truncated", name)
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(filepath.Base(name)))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting secret %s, was it encrypted with a different key? %v", name, err)
+	}
+	return plaintext, nil
+}
+
+// Save encrypts data and writes it to the file at name
+func (e *EncryptedFileSecretStore) Save(name string, data []byte) error {
+	aead, prefix := e.aead, encryptedPrefix
+	if e.passphrase != "" {
+		e.mu.Lock()
+		if e.salt == nil {
+			e.salt = make([]byte, 16)
+			if _, err := io.ReadFull(rand.Reader, e.salt); err != nil {
+				e.salt = nil
+				e.mu.Unlock()
+				return fmt.Errorf("error generating salt: %v", err)
+			}
+		}
+		salt := e.salt
+		e.mu.Unlock()
+
+		var err error
+		if aead, err = e.saltedCipher(salt); err != nil {
+			return err
+		}
+		prefix = passphrasePrefix + base64.StdEncoding.EncodeToString(salt) + ":"
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, data, []byte(filepath.Base(name)))
+	encoded := prefix + base64.StdEncoding.EncodeToString(sealed) + "\n"
+	return e.files.Save(name, []byte(encoded))
+}
+
+// kubernetesServiceAccountDir is mounted into every pod with its service account credentials
+const kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesSecretStore keeps secrets as keys of a single Kubernetes Secret, written back through the API server.
+// The pod's service account needs get, create and patch on that Secret.
+type KubernetesSecretStore struct {
+	client     *http.Client
+	apiServer  string
+	namespace  string
+	secretName string
+	tokenFile  string
+}
+
+// NewKubernetesSecretStore creates a store backed by the named Secret in the pod's own namespace
+func NewKubernetesSecretStore(secretName string) (*KubernetesSecretStore, error) {
+	if secretName == "" {
+		return nil, fmt.Errorf("set TOKEN_STORE_SECRET_NAME")
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running inside Kubernetes")
+	}
+
+	tokenFile := filepath.Join(kubernetesServiceAccountDir, "token")
+	if _, err := os.ReadFile(tokenFile); err != nil {
+		return nil, fmt.Errorf("error reading service account token: %v", err)
+	}
+	namespace, err := os.ReadFile(filepath.Join(kubernetesServiceAccountDir, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading service account namespace: %v", err)
+	}
+	caCert, err := os.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading cluster CA certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("error parsing cluster CA certificate")
+	}
+
+	return &KubernetesSecretStore{
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		},
+		apiServer:  "https://" + host + ":" + port,
+		namespace:  strings.TrimSpace(string(namespace)),
+		secretName: secretName,
+		tokenFile:  tokenFile,
+	}, nil
+}
+
+// secretKeyPattern matches the characters Kubernetes allows in Secret data keys
+var secretKeyPattern = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+
+// secretKey turns a token file path into a valid Secret data key.
+// The key ends in a hash of the whole path, so token files with the same name in different folders don't collide.
+func secretKey(name string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(name)))
+	return secretKeyPattern.ReplaceAllString(filepath.Base(name), "_") + "-" + hex.EncodeToString(sum[:4])
+}
+
+// Load reads one key of the Secret
+func (k *KubernetesSecretStore) Load(name string) ([]byte, error) {
+	resp, err := k.request("GET", k.secretURL(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error reading secret %s, status: %d", k.secretName, resp.StatusCode)
+	}
+
+	var secret struct {
+		Data map[string][]byte `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("error decoding secret %s: %v", k.secretName, err)
+	}
+
+	data, ok := secret.Data[secretKey(name)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+// Save writes one key of the Secret, creating the Secret if it doesn't exist yet
+func (k *KubernetesSecretStore) Save(name string, data []byte) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"data": map[string][]byte{secretKey(name): data},
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding secret patch: %v", err)
+	}
+
+	resp, err := k.request("PATCH", k.secretURL(), "application/merge-patch+json", patch)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		secret, err := json.Marshal(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]string{"name": k.secretName},
+			"type":       "Opaque",
+			"data":       map[string][]byte{secretKey(name): data},
+		})
+		if err != nil {
+			return fmt.Errorf("error encoding secret: %v", err)
+		}
+
+		resp, err = k.request("POST", fmt.Sprintf("%s/api/v1/namespaces/%s/secrets", k.apiServer, k.namespace), "application/json", secret)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("error writing secret %s, status: %d", k.secretName, resp.StatusCode)
+	}
+	return nil
+}
+
+func (k *KubernetesSecretStore) secretURL() string {
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/%s", k.apiServer, k.namespace, k.secretName)
+}
+
+// request calls the Kubernetes API. The service account token is read for every request,
+// since projected tokens are rotated while the pod runs.
+func (k *KubernetesSecretStore) request(method, url, contentType string, body []byte) (*http.Response, error) {
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading service account token: %v", err)
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling Kubernetes API: %v", err)
+	}
+	return resp, nil
+}
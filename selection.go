@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Values of PINNED_MESSAGES
+const (
+	pinnedAll      = "all"
+	pinnedOnly     = "pinned"
+	pinnedExcluded = "unpinned"
+)
+
+// messageSelection decides which messages of a guild have their attachments archived.
+// Empty lists and unset fields select every message.
+type messageSelection struct {
+	includeAuthors  []string
+	excludeAuthors  []string
+	includeRoles    []string
+	excludeRoles    []string
+	reaction        string // emoji, custom emoji name or name:id a message must carry
+	reactionCount   int    // how often reaction must have been added
+	excludeBots     bool
+	excludeWebhooks bool
+	pinned          string
+}
+
+// parseMessageSelection reads the message selection settings for a guild
+func parseMessageSelection(guildID string) (*messageSelection, error) {
+	env := func(key string) string { return guildEnv(guildID, key) }
+	selection := &messageSelection{
+		includeAuthors:  splitList(env("INCLUDE_AUTHORS")),
+		excludeAuthors:  splitList(env("EXCLUDE_AUTHORS")),
+		includeRoles:    splitList(env("INCLUDE_ROLES")),
+		excludeRoles:    splitList(env("EXCLUDE_ROLES")),
+		reaction:        strings.TrimSpace(env("REQUIRE_REACTION")),
+		reactionCount:   1,
+		excludeBots:     env("EXCLUDE_BOTS") == "1",
+		excludeWebhooks: env("EXCLUDE_WEBHOOKS") == "1",
+		pinned:          strings.ToLower(env("PINNED_MESSAGES")),
+	}
+
+	if env("REQUIRE_REACTION_COUNT") != "" {
+		count, err := strconv.Atoi(env("REQUIRE_REACTION_COUNT"))
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid REQUIRE_REACTION_COUNT: %q", env("REQUIRE_REACTION_COUNT"))
+		}
+		selection.reactionCount = count
+	}
+
+	switch selection.pinned {
+	case "":
+		selection.pinned = pinnedAll
+	case pinnedAll, pinnedOnly, pinnedExcluded:
+	default:
+		return nil, fmt.Errorf("invalid PINNED_MESSAGES: %q. Valid values are 'all', 'pinned' or 'unpinned'", selection.pinned)
+	}
+
+	return selection, nil
+}
+
+// splitList splits a comma separated setting, dropping empty entries
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// needsRoles reports whether selecting a message depends on its author's roles
+func (s *messageSelection) needsRoles() bool {
+	return len(s.includeRoles) > 0 || len(s.excludeRoles) > 0
+}
+
+// selects reports whether a message's attachments should be archived, and the reason when they shouldn't.
+// roles are the author's role IDs, looked up only when needsRoles is true.
+func (s *messageSelection) selects(message *discordgo.Message, roles []string) (bool, string) {
+	if s.excludeWebhooks && message.WebhookID != "" {
+		return false, "webhook"
+	}
+
+	authorID := ""
+	if message.Author != nil {
+		authorID = message.Author.ID
+		if s.excludeBots && message.Author.Bot && message.WebhookID == "" {
+			return false, "bot"
+		}
+	}
+	if len(s.includeAuthors) > 0 && !slices.Contains(s.includeAuthors, authorID) {
+		return false, "author"
+	}
+	if slices.Contains(s.excludeAuthors, authorID) {
+		return false, "author"
+	}
+
+	hasRole := func(selected []string) bool {
+		return slices.ContainsFunc(roles, func(role string) bool { return slices.Contains(selected, role) })
+	}
+	if len(s.includeRoles) > 0 && !hasRole(s.includeRoles) {
+		return false, "role"
+	}
+	if hasRole(s.excludeRoles) {
+		return false, "role"
+	}
+
+	if s.pinned == pinnedOnly && !message.Pinned {
+		return false, "pinned"
+	}
+	if s.pinned == pinnedExcluded && message.Pinned {
+		return false, "pinned"
+	}
+
+	if s.reaction != "" && reactionCount(message, s.reaction) < s.reactionCount {
+		return false, "reaction"
+	}
+
+	return true, ""
+}
+
+// reactionCount returns how often an emoji was added to a message.
+// Custom emoji can be given by name, by ID or as name:id.
+func reactionCount(message *discordgo.Message, emoji string) int {
+	for _, reaction := range message.Reactions {
+		if reaction.Emoji == nil {
+			continue
+		}
+		e := reaction.Emoji
+		if e.Name == emoji || (e.ID != "" && (e.ID == emoji || e.APIName() == emoji)) {
+			return reaction.Count
+		}
+	}
+	return 0
+}
+
+// selects reports whether a message's attachments should be archived for a guild.
+// Authors who opted out are never archived, whatever the selection settings say.
+func (t *GuildTarget) selects(message *discordgo.Message, roles []string) (bool, string) {
+	if message.Author != nil && t.OptOuts.contains(message.Author.ID) {
+		return false, "opt_out"
+	}
+	return t.Selection.selects(message, roles)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// reaperCommand is the /reaper application command registered in every archived guild
+var reaperCommand = &discordgo.ApplicationCommand{
+	Name:        "reaper",
+	Description: "Control the photo reaper",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "status",
+			Description: "Show the last run, its counts and errors",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "scan",
+			Description: "Scan a channel now",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionChannel,
+					Name:        "channel",
+					Description: "Channel to scan",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "optout",
+			Description: "Stop archiving your attachments",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "optin",
+			Description: "Archive your attachments again",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "where",
+			Description: "Show where a message's attachments were archived",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "message",
+					Description: "Link to the message",
+					Required:    true,
+				},
+			},
+		},
+	},
+}
+
+// activeTargets are the guild targets of the latest run, which slash commands act on
+var activeTargets struct {
+	sync.Mutex
+	targets []*GuildTarget
+}
+
+// setActiveTargets hands the targets of a run to the slash commands
+func setActiveTargets(targets []*GuildTarget) {
+	activeTargets.Lock()
+	defer activeTargets.Unlock()
+	activeTargets.targets = targets
+}
+
+// activeTarget returns the target of an archived guild, or nil when the guild isn't archived
+func activeTarget(guildID string) *GuildTarget {
+	activeTargets.Lock()
+	defer activeTargets.Unlock()
+
+	for _, target := range activeTargets.targets {
+		if target.GuildID == guildID {
+			return target
+		}
+	}
+	return nil
+}
+
+// registerSlashCommands registers /reaper in every configured guild and starts handling it
+func registerSlashCommands(dg *discordgo.Session) {
+	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionApplicationCommand || i.ApplicationCommandData().Name != reaperCommand.Name {
+			return
+		}
+		if err := s.InteractionRespond(i.Interaction, handleReaperCommand(s, i.Interaction)); err != nil {
+			log.Errorf("Error responding to /reaper: %v", err)
+		}
+	})
+
+	for _, guildId := range getGuildIds(dg, os.Getenv("DISCORD_GUILD_ID")) {
+		_, err := dg.ApplicationCommandBulkOverwrite(dg.State.User.ID, guildId, []*discordgo.ApplicationCommand{reaperCommand})
+		if err != nil {
+			log.Errorf("Error registering slash commands in guild %s: %v", guildId, err)
+			continue
+		}
+		log.Infof("Registered slash commands in guild %s", guildId)
+	}
+}
+
+// handleReaperCommand runs a /reaper subcommand and returns the reply, which only the caller sees
+func handleReaperCommand(dg *discordgo.Session, i *discordgo.Interaction) *discordgo.InteractionResponse {
+	if i.GuildID == "" || i.Member == nil || i.Member.User == nil {
+		return slashReply("/reaper can only be used in a server.")
+	}
+	target := activeTarget(i.GuildID)
+	if target == nil {
+		return slashReply("This server isn't archived, or the first run hasn't started yet.")
+	}
+
+	data := i.ApplicationCommandData()
+	if len(data.Options) == 0 {
+		return slashReply("Usage: /reaper status|scan|optout|optin|where")
+	}
+	subcommand := data.Options[0]
+	if !slashAllowed(target.GuildID, subcommand.Name, i.Member) {
+		log.Warnf("User %s was denied /reaper %s in guild %s", i.Member.User.ID, subcommand.Name, i.GuildID)
+		return slashReply(fmt.Sprintf("You don't have a role allowed to use /reaper %s.", subcommand.Name))
+	}
+
+	switch subcommand.Name {
+	case "status":
+		return slashReply(slashStatus(target))
+	case "scan":
+		return slashReply(slashScan(dg, i, target, slashOption(subcommand, "channel")))
+	case "optout":
+		if !target.OptOuts.add(i.Member.User.ID, "slash") {
+			return slashReply("You've already opted out.")
+		}
+		audit(target.GuildID, AuditEntry{Action: auditOptOut, UserID: i.Member.User.ID, Result: "slash"})
+		return slashReply("You've opted out. Your attachments won't be archived from now on. What was already archived stays until an admin runs a purge.")
+	case "optin":
+		if !target.OptOuts.remove(i.Member.User.ID) {
+			return slashReply("You haven't opted out.")
+		}
+		audit(target.GuildID, AuditEntry{Action: auditOptIn, UserID: i.Member.User.ID, Result: "slash"})
+		return slashReply("You've opted back in. Your attachments will be archived again.")
+	case "where":
+		return slashReply(slashWhere(target, slashOption(subcommand, "message")))
+	default:
+		return slashReply(fmt.Sprintf("Unknown subcommand %s.", subcommand.Name))
+	}
+}
+
+// slashAllowed reports whether a member may use a subcommand.
+// optout and optin only affect the caller, so they're open to everyone unless SLASH_OPTOUT_ROLES is set.
+// The other subcommands need a role in SLASH_COMMAND_ROLES, or the Manage Server permission when none are set.
+func slashAllowed(guildID, subcommand string, member *discordgo.Member) bool {
+	hasRole := func(allowed []string) bool {
+		return slices.ContainsFunc(member.Roles, func(role string) bool { return slices.Contains(allowed, role) })
+	}
+
+	if subcommand == "optout" || subcommand == "optin" {
+		allowed := splitList(guildEnv(guildID, "SLASH_OPTOUT_ROLES"))
+		return len(allowed) == 0 || hasRole(allowed)
+	}
+
+	allowed := splitList(guildEnv(guildID, "SLASH_COMMAND_ROLES"))
+	if len(allowed) == 0 {
+		return member.Permissions&discordgo.PermissionManageServer != 0
+	}
+	return hasRole(allowed)
+}
+
+// slashOption returns the value of a subcommand's option as a string, which for channels is their ID
+func slashOption(subcommand *discordgo.ApplicationCommandInteractionDataOption, name string) string {
+	for _, option := range subcommand.Options {
+		if option.Name == name {
+			if value, ok := option.Value.(string); ok {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// slashReply builds a reply only the caller of a command can see
+func slashReply(content string) *discordgo.InteractionResponse {
+	// Discord rejects messages over 2000 characters
+	if len(content) > 2000 {
+		content = strings.ToValidUTF8(content[:1997], "") + "..."
+	}
+	return &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	}
+}
+
+// slashStatus describes the latest run over a guild and its retry queue
+func slashStatus(target *GuildTarget) string {
+	var lines []string
+	status, ok := guildRunStatus(target.GuildID)
+	switch {
+	case !ok:
+		lines = append(lines, "No run has started yet.")
+	case status.Running:
+		lines = append(lines, fmt.Sprintf("A run is in progress, started <t:%d:R>.", status.Started.Unix()))
+	default:
+		lines = append(lines, fmt.Sprintf("The last run started <t:%d:f> and finished <t:%d:R>.", status.Started.Unix(), status.Finished.Unix()))
+	}
+	if ok {
+		lines = append(lines, fmt.Sprintf("Messages scanned: %d, skipped: %d. Files archived: %d, failed: %d.", status.Messages, status.Skipped, status.Uploaded, status.Failed))
+	}
+
+	pending := len(target.Retries.list(target.GuildID, false))
+	dead := len(target.Retries.list(target.GuildID, true))
+	lines = append(lines, fmt.Sprintf("Retry queue: %d pending, %d dead letters.", pending, dead))
+	if status.LastError != "" {
+		lines = append(lines, fmt.Sprintf("Last error: %s", status.LastError))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// slashScan starts an on-demand scan of a channel once any run in progress has finished
+func slashScan(dg *discordgo.Session, i *discordgo.Interaction, target *GuildTarget, channelID string) string {
+	channel := slashChannel(dg, i, channelID)
+	if channel == nil {
+		return "That channel couldn't be found."
+	}
+	if channel.GuildID != target.GuildID {
+		return "That channel isn't in this server."
+	}
+
+	log.Infof("User %s requested a scan of channel %s in guild %s", i.Member.User.ID, channelID, target.GuildID)
+	queueChannelScan(dg, target, channel, func() {
+		_, err := dg.FollowupMessageCreate(i, false, &discordgo.WebhookParams{
+			Content: fmt.Sprintf("Finished scanning <#%s>.", channelID),
+			Flags:   discordgo.MessageFlagsEphemeral,
+		})
+		if err != nil {
+			log.Debugf("Could not report the finished scan of channel %s: %v", channelID, err)
+		}
+	})
+
+	return fmt.Sprintf("Scan of <#%s> queued. It starts once any run in progress has finished.", channelID)
+}
+
+// slashChannel looks up a channel option without a REST call, which could outlast the deadline for answering the interaction.
+// Discord resolves the channels picked in options itself, and the session state holds the channels of every guild the bot is in.
+func slashChannel(dg *discordgo.Session, i *discordgo.Interaction, channelID string) *discordgo.Channel {
+	if resolved := i.ApplicationCommandData().Resolved; resolved != nil {
+		if channel, ok := resolved.Channels[channelID]; ok {
+			// Resolved channels are partial, but channel options only offer channels of the interaction's guild
+			if channel.GuildID == "" {
+				channel.GuildID = i.GuildID
+			}
+			return channel
+		}
+	}
+	if dg != nil {
+		if channel, err := dg.State.Channel(channelID); err == nil {
+			return channel
+		}
+	}
+	return nil
+}
+
+// messageLinkPattern matches a Discord message link, capturing the guild, channel and message IDs
+var messageLinkPattern = regexp.MustCompile(`^https://(?:(?:ptb|canary)\.)?discord(?:app)?\.com/channels/(\d+)/(\d+)/(\d+)`)
+
+// slashWhere lists where the attachments of a linked message were archived
+func slashWhere(target *GuildTarget, link string) string {
+	match := messageLinkPattern.FindStringSubmatch(strings.TrimSpace(link))
+	if match == nil {
+		return "That isn't a message link. Use Copy Message Link on the message."
+	}
+	if match[1] != target.GuildID {
+		return "That message isn't in this server."
+	}
+	messageID := match[3]
+
+	records := []*FileRecord{}
+	for _, record := range target.State.records() {
+		if record.MessageID == messageID {
+			records = append(records, record)
+		}
+	}
+	if len(records) == 0 {
+		return "No archived attachments were found for that message."
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	lines := []string{}
+	for _, record := range records {
+		if record.Type == recordTypeDuplicate {
+			original := record.DuplicateOf
+			if file, ok := target.State.lookupFile(record.DuplicateOf); ok {
+				original = recordPath(file)
+			}
+			lines = append(lines, fmt.Sprintf("`%s` is a duplicate of `%s` on %s", record.Filename, original, record.Destination))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("`%s` archived to %s as `%s` <t:%d:R>", record.Filename, record.Destination, recordPath(record), record.Time.Unix()))
+	}
+	return strings.Join(lines, "\n")
+}
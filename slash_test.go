@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSlashAllowed(t *testing.T) {
+	const manageServer = discordgo.PermissionManageServer
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		subcommand  string
+		roles       []string
+		permissions int64
+		want        bool
+	}{
+		{name: "status needs manage server", subcommand: "status", want: false},
+		{name: "status with manage server", subcommand: "status", permissions: manageServer, want: true},
+		{name: "where needs manage server", subcommand: "where", roles: []string{"archivist"}, want: false},
+		{name: "scan with manage server among other permissions", subcommand: "scan", permissions: manageServer | discordgo.PermissionSendMessages, want: true},
+		{
+			name:       "command role allowed",
+			env:        map[string]string{"SLASH_COMMAND_ROLES": "archivist,mods"},
+			subcommand: "scan",
+			roles:      []string{"member", "mods"},
+			want:       true,
+		},
+		{
+			name:        "command roles replace manage server",
+			env:         map[string]string{"SLASH_COMMAND_ROLES": "archivist"},
+			subcommand:  "status",
+			roles:       []string{"member"},
+			permissions: manageServer,
+			want:        false,
+		},
+		{
+			name:       "guild override of command roles",
+			env:        map[string]string{"SLASH_COMMAND_ROLES": "archivist", "GUILD_111_SLASH_COMMAND_ROLES": "curators"},
+			subcommand: "status",
+			roles:      []string{"curators"},
+			want:       true,
+		},
+		{
+			name:       "global command roles ignored under guild override",
+			env:        map[string]string{"SLASH_COMMAND_ROLES": "archivist", "GUILD_111_SLASH_COMMAND_ROLES": "curators"},
+			subcommand: "status",
+			roles:      []string{"archivist"},
+			want:       false,
+		},
+		{name: "optout open to everyone", subcommand: "optout", want: true},
+		{name: "optin open to everyone", subcommand: "optin", want: true},
+		{
+			name:       "optout unaffected by command roles",
+			env:        map[string]string{"SLASH_COMMAND_ROLES": "archivist"},
+			subcommand: "optout",
+			want:       true,
+		},
+		{
+			name:        "optout roles required",
+			env:         map[string]string{"SLASH_OPTOUT_ROLES": "verified"},
+			subcommand:  "optout",
+			permissions: manageServer,
+			want:        false,
+		},
+		{
+			name:       "optin with optout role",
+			env:        map[string]string{"SLASH_OPTOUT_ROLES": "verified"},
+			subcommand: "optin",
+			roles:      []string{"verified"},
+			want:       true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, key := range []string{"SLASH_COMMAND_ROLES", "SLASH_OPTOUT_ROLES", "GUILD_111_SLASH_COMMAND_ROLES"} {
+				t.Setenv(key, test.env[key])
+			}
+
+			member := &discordgo.Member{User: &discordgo.User{ID: "555"}, Roles: test.roles, Permissions: test.permissions}
+			if got := slashAllowed("111", test.subcommand, member); got != test.want {
+				t.Errorf("slashAllowed(%s) = %v, want %v", test.subcommand, got, test.want)
+			}
+		})
+	}
+}
+
+// newSlashTarget returns a guild target for guild 111 whose state records two attachments of message 333,
+// one of them a duplicate, and one attachment of message 444
+func newSlashTarget(t *testing.T) *GuildTarget {
+	dir := t.TempDir()
+	t.Setenv("STATE_FILE", filepath.Join(dir, "state"))
+
+	state := openStateStore(filepath.Join(dir, "state"))
+	posted := time.Unix(1700000000, 0)
+	state.recordFile(&FileRecord{Type: recordTypeFile, Entity: "https://cdn.discordapp.com/attachments/222/900/cat.png", Filename: "cat.png", Destination: "guild:default", MessageID: "444", Time: posted})
+	state.recordFile(&FileRecord{Type: recordTypeFile, Entity: "https://cdn.discordapp.com/attachments/222/901/dog.png", Filename: "dog.png", Path: "2023/dog.png", Destination: "photos", MessageID: "333", Time: posted.Add(time.Minute)})
+	state.recordFile(&FileRecord{Type: recordTypeDuplicate, Entity: "https://cdn.discordapp.com/attachments/222/902/cat.png", Filename: "cat.png", Destination: "guild:default", MessageID: "333", DuplicateOf: "https://cdn.discordapp.com/attachments/222/900/cat.png", Time: posted.Add(2 * time.Minute)})
+
+	return &GuildTarget{
+		GuildID: "111",
+		State:   state,
+		Retries: openRetryQueue(filepath.Join(dir, "state.retry")),
+		OptOuts: openOptOutRegistry(filepath.Join(dir, "state.optout")),
+	}
+}
+
+func TestSlashWhere(t *testing.T) {
+	target := newSlashTarget(t)
+
+	tests := []struct {
+		name string
+		link string
+		want []string
+	}{
+		{
+			name: "archived message",
+			link: "https://discord.com/channels/111/222/333",
+			want: []string{"`dog.png` archived to photos as `2023/dog.png` <t:1700000060:R>", "`cat.png` is a duplicate of `cat.png` on guild:default"},
+		},
+		{name: "ptb link", link: "https://ptb.discord.com/channels/111/222/444", want: []string{"`cat.png` archived to guild:default as `cat.png`"}},
+		{name: "canary link", link: "https://canary.discord.com/channels/111/222/444", want: []string{"`cat.png` archived to guild:default"}},
+		{name: "legacy domain", link: "https://discordapp.com/channels/111/222/444", want: []string{"`cat.png` archived to guild:default"}},
+		{name: "surrounding whitespace", link: "  https://discord.com/channels/111/222/444\n", want: []string{"`cat.png` archived to guild:default"}},
+		{name: "nothing archived", link: "https://discord.com/channels/111/222/999", want: []string{"No archived attachments were found for that message."}},
+		{name: "other server", link: "https://discord.com/channels/777/222/333", want: []string{"That message isn't in this server."}},
+		{name: "channel link", link: "https://discord.com/channels/111/222", want: []string{"That isn't a message link."}},
+		{name: "other site", link: "https://example.com/channels/111/222/333", want: []string{"That isn't a message link."}},
+		{name: "plain message ID", link: "333", want: []string{"That isn't a message link."}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := slashWhere(target, test.link)
+			lines := strings.Split(got, "\n")
+			if len(lines) != len(test.want) {
+				t.Fatalf("slashWhere(%q) = %q, want %d lines", test.link, got, len(test.want))
+			}
+			for i, want := range test.want {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("slashWhere(%q) line %d = %q, want %q", test.link, i+1, lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+// slashInteraction decodes an application command interaction the way Discord sends it to the bot
+func slashInteraction(t *testing.T, payload string) *discordgo.Interaction {
+	t.Helper()
+	interaction := &discordgo.Interaction{}
+	if err := json.Unmarshal([]byte(payload), interaction); err != nil {
+		t.Fatalf("error decoding interaction: %v", err)
+	}
+	return interaction
+}
+
+func TestHandleReaperCommand(t *testing.T) {
+	const (
+		member    = `"member": {"user": {"id": "555", "username": "someone"}, "roles": [], "permissions": "0"}`
+		moderator = `"member": {"user": {"id": "556", "username": "moderator"}, "roles": [], "permissions": "32"}`
+	)
+	command := func(guild, member, options string) string {
+		return `{"id": "1", "application_id": "2", "type": 2, "token": "token", "version": 1, "guild_id": "` + guild + `", ` + member +
+			`, "data": {"id": "3", "name": "reaper", "type": 1, "options": [` + options + `]}}`
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{
+			name:    "direct message",
+			payload: `{"id": "1", "application_id": "2", "type": 2, "token": "token", "version": 1, "user": {"id": "555"}, "data": {"id": "3", "name": "reaper", "type": 1, "options": [{"name": "status", "type": 1}]}}`,
+			want:    "/reaper can only be used in a server.",
+		},
+		{name: "unarchived server", payload: command("777", member, `{"name": "status", "type": 1}`), want: "This server isn't archived"},
+		{name: "no subcommand", payload: command("111", moderator, ``), want: "Usage: /reaper"},
+		{name: "status denied", payload: command("111", member, `{"name": "status", "type": 1}`), want: "You don't have a role allowed to use /reaper status."},
+		{name: "scan denied", payload: command("111", member, `{"name": "scan", "type": 1, "options": [{"name": "channel", "type": 7, "value": "222"}]}`), want: "You don't have a role allowed to use /reaper scan."},
+		{name: "where denied", payload: command("111", member, `{"name": "where", "type": 1, "options": [{"name": "message", "type": 3, "value": "https://discord.com/channels/111/222/333"}]}`), want: "You don't have a role allowed"},
+		{name: "scan of an unknown channel", payload: command("111", moderator, `{"name": "scan", "type": 1, "options": [{"name": "channel", "type": 7, "value": "222"}]}`), want: "That channel couldn't be found."},
+		{
+			name: "scan of a channel in another server",
+			payload: strings.Replace(command("111", moderator, `{"name": "scan", "type": 1, "options": [{"name": "channel", "type": 7, "value": "888"}]}`),
+				`"type": 1, "options"`, `"type": 1, "resolved": {"channels": {"888": {"id": "888", "guild_id": "777", "type": 0}}}, "options"`, 1),
+			want: "That channel isn't in this server.",
+		},
+		{name: "status", payload: command("111", moderator, `{"name": "status", "type": 1}`), want: "No run has started yet.\nRetry queue: 0 pending, 0 dead letters."},
+		{name: "where", payload: command("111", moderator, `{"name": "where", "type": 1, "options": [{"name": "message", "type": 3, "value": "https://discord.com/channels/111/222/444"}]}`), want: "`cat.png` archived to guild:default"},
+		{name: "unknown subcommand", payload: command("111", moderator, `{"name": "export", "type": 1}`), want: "Unknown subcommand export."},
+		{name: "optin before opting out", payload: command("111", member, `{"name": "optin", "type": 1}`), want: "You haven't opted out."},
+		{name: "optout", payload: command("111", member, `{"name": "optout", "type": 1}`), want: "You've opted out."},
+		{name: "optout twice", payload: command("111", member, `{"name": "optout", "type": 1}`), want: "You've already opted out."},
+		{name: "optin", payload: command("111", member, `{"name": "optin", "type": 1}`), want: "You've opted back in."},
+	}
+
+	t.Setenv("SLASH_COMMAND_ROLES", "")
+	t.Setenv("SLASH_OPTOUT_ROLES", "")
+	target := newSlashTarget(t)
+	setActiveTargets([]*GuildTarget{target})
+	t.Cleanup(func() { setActiveTargets(nil) })
+
+	// The cases run in order, since the opt-out cases build on each other
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := handleReaperCommand(nil, slashInteraction(t, test.payload))
+			if response.Type != discordgo.InteractionResponseChannelMessageWithSource || response.Data.Flags != discordgo.MessageFlagsEphemeral {
+				t.Errorf("handleReaperCommand() response type %d, flags %d, want an ephemeral message", response.Type, response.Data.Flags)
+			}
+			if !strings.HasPrefix(response.Data.Content, test.want) {
+				t.Errorf("handleReaperCommand() = %q, want %q", response.Data.Content, test.want)
+			}
+		})
+	}
+
+	if target.OptOuts.contains("555") {
+		t.Errorf("user 555 is still opted out after opting back in")
+	}
+	audited, err := os.ReadFile(auditLogPath("111"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(audited), "\n"); got != 2 {
+		t.Errorf("audit log has %d entries, want the opt-out and the opt-in:\n%s", got, audited)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FileRecord describes an archived attachment. It is persisted as a JSON line in the state file.
+type FileRecord struct {
+	Type        string    `json:"type"`
+	Entity      string    `json:"entity"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Size        int       `json:"size,omitempty"`
+	Filename    string    `json:"filename,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	GuildID     string    `json:"guild_id,omitempty"`
+	ChannelID   string    `json:"channel_id,omitempty"`
+	MessageID   string    `json:"message_id,omitempty"`
+	AuthorID    string    `json:"author_id,omitempty"`
+	DuplicateOf string    `json:"duplicate_of,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	RemoteID    string    `json:"remote_id,omitempty"`
+	Time        time.Time `json:"time"`
+
+	// Perceptual hash of image attachments, and the closest earlier upload within the configured distance
+	PHash           string `json:"phash,omitempty"`
+	NearDuplicateOf string `json:"near_duplicate_of,omitempty"`
+	PHashDistance   int    `json:"phash_distance,omitempty"`
+}
+
+const (
+	recordTypeFile      = "file"
+	recordTypeDuplicate = "duplicate"
+	recordTypeForgotten = "forgotten" // drops an earlier line's entity, so it is processed again
+)
+
+// StateStore tracks which entities have already been processed and persists them to a file.
+// Plain lines record a processed entity; JSON lines carry a FileRecord.
+type StateStore struct {
+	path     string
+	entities sync.Map
+	files    sync.Map // entity -> *FileRecord
+	hashes   sync.Map // sha256 -> *FileRecord of the first upload
+	mu       sync.Mutex
+
+	phashes []*FileRecord // uploads with a perceptual hash, searched linearly by Hamming distance
+	phashMu sync.RWMutex
+}
+
+// openStateStore loads the processed entities previously recorded at path.
+// Entities recorded by earlier versions with signed attachment URLs are rewritten without their signature.
+func openStateStore(path string) *StateStore {
+	store := &StateStore{path: path}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("Error opening processed entities file: %v", err)
+		}
+		return store
+	}
+	defer file.Close()
+
+	signed := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "{") {
+			if entity := attachmentEntity(line); entity != line {
+				line = entity
+				signed++
+			}
+			store.entities.Store(line, true)
+			continue
+		}
+
+		record := &FileRecord{}
+		if err := json.Unmarshal([]byte(line), record); err != nil {
+			log.Errorf("Skipping malformed state record %q: %v", line, err)
+			continue
+		}
+		if strings.Contains(record.Entity+record.DuplicateOf+record.NearDuplicateOf, "?") {
+			record.Entity = attachmentEntity(record.Entity)
+			record.DuplicateOf = attachmentEntity(record.DuplicateOf)
+			record.NearDuplicateOf = attachmentEntity(record.NearDuplicateOf)
+			signed++
+		}
+		if record.Type == recordTypeForgotten {
+			store.unindex(record.Entity)
+			continue
+		}
+		store.index(record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Error reading processed entity file: %v", err)
+		return store
+	}
+
+	if signed > 0 {
+		if err := store.compact(); err != nil {
+			log.Errorf("Error compacting state file: %v", err)
+		} else {
+			log.Infof("Dropped the signature from %d attachment URLs in %s", signed, path)
+		}
+	}
+
+	return store
+}
+
+// index adds a record to the in-memory lookups. A later record for the same entity replaces the earlier one.
+func (s *StateStore) index(record *FileRecord) {
+	s.entities.Store(record.Entity, true)
+	previous, replaced := s.files.Swap(record.Entity, record)
+	if replaced {
+		s.unindexHashes(previous.(*FileRecord))
+	}
+
+	if record.Type == recordTypeFile && record.SHA256 != "" {
+		s.hashes.LoadOrStore(record.SHA256, record)
+	}
+	if record.Type == recordTypeFile && record.PHash != "" {
+		s.phashMu.Lock()
+		s.phashes = append(s.phashes, record)
+		s.phashMu.Unlock()
+	}
+}
+
+// unindex removes an entity from the in-memory lookups
+func (s *StateStore) unindex(entity string) {
+	s.entities.Delete(entity)
+	value, ok := s.files.LoadAndDelete(entity)
+	if ok {
+		s.unindexHashes(value.(*FileRecord))
+	}
+}
+
+// unindexHashes removes a record from the hash lookups
+func (s *StateStore) unindexHashes(record *FileRecord) {
+	if record.SHA256 != "" {
+		s.hashes.CompareAndDelete(record.SHA256, record)
+	}
+	if record.PHash != "" {
+		s.phashMu.Lock()
+		s.phashes = slices.DeleteFunc(s.phashes, func(other *FileRecord) bool { return other == record })
+		s.phashMu.Unlock()
+	}
+}
+
+// appendLine persists a single line to the state file
+func (s *StateStore) appendLine(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorf("Error opening processed entities file for append: %v", err)
+		return
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(fmt.Sprintf("%s\n", line))
+	if err != nil {
+		log.Errorf("Error writing entity to processed entities file: %v", err)
+	}
+}
+
+// recordOk marks an entity as successfully processed and persists it to the file
+func (s *StateStore) recordOk(entity string) {
+	if _, loaded := s.entities.LoadOrStore(entity, true); !loaded {
+		s.appendLine(entity)
+	}
+}
+
+// recordFile marks the record's entity as processed and persists the record to the file
+func (s *StateStore) recordFile(record *FileRecord) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("Error encoding state record for %s: %v", record.Entity, err)
+		return
+	}
+
+	s.index(record)
+	s.appendLine(string(line))
+}
+
+// forget drops an entity so it is processed again on the next run, and persists that to the file
+func (s *StateStore) forget(entity string) {
+	if !s.checkOk(entity) {
+		return
+	}
+
+	line, err := json.Marshal(&FileRecord{Type: recordTypeForgotten, Entity: entity, Time: time.Now()})
+	if err != nil {
+		log.Errorf("Error encoding state record for %s: %v", entity, err)
+		return
+	}
+
+	s.unindex(entity)
+	s.appendLine(string(line))
+}
+
+// compact rewrites the state file with only the current record of every entity.
+// Forgotten entities and replaced records, along with everything they recorded, are dropped from the file.
+// The lock is held from the snapshot to the write, so lines appended meanwhile in this process aren't lost.
+// Lines another process appends are, so commands that compact, such as purge, must not run alongside the archiver.
+func (s *StateStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plain := []string{}
+	s.entities.Range(func(key, _ any) bool {
+		if _, ok := s.files.Load(key); !ok {
+			plain = append(plain, key.(string))
+		}
+		return true
+	})
+	sort.Strings(plain)
+
+	records := s.records()
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	var lines strings.Builder
+	for _, entity := range plain {
+		lines.WriteString(entity + "\n")
+	}
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("error encoding state record for %s: %v", record.Entity, err)
+		}
+		lines.Write(line)
+		lines.WriteString("\n")
+	}
+
+	return writeFileAtomic(s.path, lines.String())
+}
+
+// records returns the file records of every archived entity
+func (s *StateStore) records() []*FileRecord {
+	records := []*FileRecord{}
+	s.files.Range(func(_, value any) bool {
+		records = append(records, value.(*FileRecord))
+		return true
+	})
+	return records
+}
+
+// checkOk returns true if an entity has already been marked OK.
+func (s *StateStore) checkOk(entity string) bool {
+	_, exists := s.entities.Load(entity)
+	return exists
+}
+
+// lookupFile returns the record of an archived entity
+func (s *StateStore) lookupFile(entity string) (*FileRecord, bool) {
+	record, ok := s.files.Load(entity)
+	if !ok {
+		return nil, false
+	}
+	return record.(*FileRecord), true
+}
+
+// lookupHash returns the record of the first upload with the given sha256
+func (s *StateStore) lookupHash(sha256 string) (*FileRecord, bool) {
+	record, ok := s.hashes.Load(sha256)
+	if !ok {
+		return nil, false
+	}
+	return record.(*FileRecord), true
+}
+
+// lookupPerceptualHash returns the upload whose perceptual hash is closest to phash, if it is within maxDistance
+func (s *StateStore) lookupPerceptualHash(phash string, maxDistance int) (*FileRecord, int, bool) {
+	s.phashMu.RLock()
+	defer s.phashMu.RUnlock()
+
+	var closest *FileRecord
+	closestDistance := maxDistance + 1
+	for _, record := range s.phashes {
+		if distance, ok := perceptualHashDistance(phash, record.PHash); ok && distance < closestDistance {
+			closest = record
+			closestDistance = distance
+		}
+	}
+
+	if closest == nil {
+		return nil, 0, false
+	}
+	return closest, closestDistance, true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// runStatus summarises the latest run over a guild, for /reaper status and the run report
+type runStatus struct {
+	Started      time.Time                   `json:"started"`
+	Finished     time.Time                   `json:"finished"`
+	Running      bool                        `json:"running"`
+	Channels     int                         `json:"channels_scanned"`
+	Messages     int                         `json:"messages_checked"`
+	Skipped      int                         `json:"messages_skipped"` // messages left out by the message selection
+	Uploaded     int                         `json:"files_uploaded"`
+	Duplicates   int                         `json:"files_skipped"` // files not uploaded because an identical or similar file was already archived
+	Bytes        int64                       `json:"bytes_uploaded"`
+	Failed       int                         `json:"files_failed"`
+	LastError    string                      `json:"last_error,omitempty"`
+	ErrorClasses map[string]*errorClassCount `json:"error_classes"`
+}
+
+// errorClassCount counts the failures of one error class, keeping the latest message as an example
+type errorClassCount struct {
+	Count   int    `json:"count"`
+	Example string `json:"example"`
+}
+
+var (
+	runStatusMu sync.Mutex
+	runStatuses = map[string]*runStatus{} // guild ID -> status of the latest run
+)
+
+// startRunStatus resets a guild's counts at the start of a run
+func startRunStatus(guildID string) {
+	runStatusMu.Lock()
+	defer runStatusMu.Unlock()
+	runStatuses[guildID] = &runStatus{Started: time.Now(), Running: true, ErrorClasses: map[string]*errorClassCount{}}
+}
+
+// finishRunStatus marks a guild's run as complete
+func finishRunStatus(guildID string) {
+	updateRunStatus(guildID, func(status *runStatus) {
+		status.Running = false
+		status.Finished = time.Now()
+	})
+}
+
+// updateRunStatus applies update to a guild's status, starting one if the guild hasn't run yet
+func updateRunStatus(guildID string, update func(status *runStatus)) {
+	runStatusMu.Lock()
+	defer runStatusMu.Unlock()
+
+	status, ok := runStatuses[guildID]
+	if !ok {
+		status = &runStatus{ErrorClasses: map[string]*errorClassCount{}}
+		runStatuses[guildID] = status
+	}
+	update(status)
+}
+
+// guildRunStatus returns a copy of a guild's latest run status, and false when it hasn't run yet
+func guildRunStatus(guildID string) (runStatus, bool) {
+	runStatusMu.Lock()
+	defer runStatusMu.Unlock()
+
+	status, ok := runStatuses[guildID]
+	if !ok {
+		return runStatus{}, false
+	}
+	copied := *status
+	copied.ErrorClasses = map[string]*errorClassCount{}
+	for class, count := range status.ErrorClasses {
+		copied.ErrorClasses[class] = &errorClassCount{Count: count.Count, Example: count.Example}
+	}
+	return copied, true
+}
+
+// countFailure records a failed attachment of a guild under its error class
+func countFailure(guildID, class, message string) {
+	updateRunStatus(guildID, func(status *runStatus) {
+		status.Failed++
+		status.LastError = message
+		count, ok := status.ErrorClasses[class]
+		if !ok {
+			count = &errorClassCount{}
+			status.ErrorClasses[class] = count
+		}
+		count.Count++
+		count.Example = message
+	})
+}
+
+// transfer is an attachment being downloaded and archived right now
+type transfer struct {
+	AttachmentID string    `json:"attachment_id"`
+	GuildID      string    `json:"guild_id"`
+	ChannelID    string    `json:"channel_id"`
+	MessageID    string    `json:"message_id"`
+	Filename     string    `json:"filename"`
+	Size         int       `json:"size"`
+	Destination  string    `json:"destination"`
+	Started      time.Time `json:"started"`
+}
+
+// inFlight holds the transfers in progress, keyed by attachment ID
+var inFlight sync.Map
+
+// startTransfer records an attachment as in flight, and returns the function that clears it once done
+func startTransfer(job *attachmentJob, storage StorageProvider) func() {
+	inFlight.Store(job.Attachment.ID, &transfer{
+		AttachmentID: job.Attachment.ID,
+		GuildID:      job.Target.GuildID,
+		ChannelID:    job.Channel.ID,
+		MessageID:    job.Message.ID,
+		Filename:     job.Attachment.Filename,
+		Size:         job.Attachment.Size,
+		Destination:  job.Target.Router.destinationName(storage),
+		Started:      time.Now(),
+	})
+	return func() { inFlight.Delete(job.Attachment.ID) }
+}
+
+// inFlightTransfers returns the transfers in progress, oldest first
+func inFlightTransfers() []*transfer {
+	transfers := []*transfer{}
+	inFlight.Range(func(_, value any) bool {
+		transfers = append(transfers, value.(*transfer))
+		return true
+	})
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].Started.Before(transfers[j].Started) })
+	return transfers
+}
@@ -1,14 +1,143 @@
 package main
 
 import (
-	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
 )
 
 // StorageProvider defines the interface for cloud storage providers
 type StorageProvider interface {
-	// Upload uploads a file to cloud storage
-	Upload(data *bytes.Buffer, filename string) error
+	// Upload streams a file to cloud storage and returns what the provider reports it stored
+	Upload(data io.Reader, filename string) (*RemoteFile, error)
+
+	// Stat returns the stored file ref points at. It returns os.ErrNotExist when there is no such file.
+	Stat(ref FileRef) (*RemoteFile, error)
+
+	// Open streams the contents of the stored file ref points at
+	Open(ref FileRef) (io.ReadCloser, error)
+
+	// Exists reports whether ref points at a stored file
+	Exists(ref FileRef) (bool, error)
+
+	// List returns one page of the files stored under the root folder, including its subfolders.
+	// Pass "" to start listing, then the returned token until it comes back "". A page may be empty before the last one.
+	List(pageToken string) (files []*RemoteFile, nextPageToken string, err error)
+
+	// Delete removes the stored file ref points at
+	Delete(ref FileRef) error
+
+	// Capabilities describes what the provider supports beyond uploading
+	Capabilities() StorageCapabilities
 
 	// GetName returns the name of the storage provider
 	GetName() string
 }
+
+// RemoteFile describes a file as reported by a storage provider.
+// Providers fill in whichever checksums they compute; empty fields are not verified.
+type RemoteFile struct {
+	ID           string
+	Name         string
+	Path         string // relative to the root folder, slash separated
+	Size         int64
+	MD5          string // hex
+	SHA1         string // hex
+	SHA256       string // hex
+	QuickXorHash string // base64, OneDrive only
+}
+
+// FileRef points at a stored file by its provider ID, or by its path under the root folder when ID is empty
+type FileRef struct {
+	ID   string
+	Path string
+}
+
+// StorageCapabilities describes what a storage provider supports beyond uploading
+type StorageCapabilities struct {
+	List       bool
+	StatByID   bool
+	StatByPath bool
+	Delete     bool
+
+	// Checksums lists the checksums filled in on RemoteFile, such as "md5" or "sha256"
+	Checksums []string
+	// MaxUploadSize is the largest supported upload in bytes, or 0 when there is no limit
+	MaxUploadSize int64
+}
+
+// listAll follows every page of a storage provider's listing
+func listAll(storage StorageProvider) ([]*RemoteFile, error) {
+	files := []*RemoteFile{}
+	pageToken := ""
+	for {
+		page, next, err := storage.List(pageToken)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, page...)
+		if next == "" {
+			return files, nil
+		}
+		pageToken = next
+	}
+}
+
+// statExists turns the result of Stat into the result of Exists
+func statExists(_ *RemoteFile, err error) (bool, error) {
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// listCursor is the position in a recursive, paginated folder listing.
+// It is handed to callers as an opaque page token.
+type listCursor struct {
+	// Folders still to list, the first of which is being listed
+	Folders []listFolder `json:"folders"`
+	// Page is the provider's own page token within the first folder
+	Page string `json:"page,omitempty"`
+}
+
+// listFolder is a folder queued for listing, along with the path prefix of its files
+type listFolder struct {
+	ID     string `json:"id"`
+	Prefix string `json:"prefix"`
+}
+
+// encode returns the page token for the cursor, or "" once every folder has been listed
+func (c *listCursor) encode() string {
+	if len(c.Folders) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeListCursor reads a page token, starting at root when the token is empty
+func decodeListCursor(pageToken string, root listFolder) (*listCursor, error) {
+	if pageToken == "" {
+		return &listCursor{Folders: []listFolder{root}}, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token: %v", err)
+	}
+	cursor := &listCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, fmt.Errorf("invalid page token: %v", err)
+	}
+	return cursor, nil
+}
+
+// advance moves past the first folder once its last page has been listed
+func (c *listCursor) advance(nextPage string) {
+	c.Page = nextPage
+	if nextPage == "" {
+		c.Folders = c.Folders[1:]
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// conformanceFiles are uploaded by the conformance suite, in this order, keyed by path
+var conformanceFiles = []struct {
+	path    string
+	content string
+}{
+	{"a.txt", "alpha"},
+	{"photos/b.png", "bravo"},
+	{"photos/2024/c.jpg", "charlie"},
+	{"it's d.txt", "delta"},
+	{"e.gif", "echo"},
+}
+
+// testStorageConformance checks that a provider behaves the way the archive, reconcile, migrate and purge code expects.
+// newStorage returns an empty provider for every subtest.
+func testStorageConformance(t *testing.T, newStorage func(t *testing.T) StorageProvider) {
+	t.Run("empty", func(t *testing.T) {
+		storage := newStorage(t)
+
+		files, err := listAll(storage)
+		if err != nil {
+			t.Fatalf("List() error = %v", err)
+		}
+		if len(files) != 0 {
+			t.Errorf("List() = %d files, want none", len(files))
+		}
+
+		ref := FileRef{Path: "missing.txt"}
+		if _, err := storage.Stat(ref); !os.IsNotExist(err) {
+			t.Errorf("Stat(missing) error = %v, want os.ErrNotExist", err)
+		}
+		if exists, err := storage.Exists(ref); exists || err != nil {
+			t.Errorf("Exists(missing) = %v, %v, want false, nil", exists, err)
+		}
+		if err := storage.Delete(ref); !os.IsNotExist(err) {
+			t.Errorf("Delete(missing) error = %v, want os.ErrNotExist", err)
+		}
+	})
+
+	t.Run("lifecycle", func(t *testing.T) {
+		storage := newStorage(t)
+		capabilities := storage.Capabilities()
+
+		uploaded := map[string]*RemoteFile{}
+		for _, file := range conformanceFiles {
+			remote, err := storage.Upload(bytes.NewBufferString(file.content), file.path)
+			if err != nil {
+				t.Fatalf("Upload(%s) error = %v", file.path, err)
+			}
+			if err := verifyRemoteFile(digestPayload([]byte(file.content)), remote); err != nil {
+				t.Errorf("Upload(%s) %v", file.path, err)
+			}
+			if remote.Path != file.path {
+				t.Errorf("Upload(%s) path = %q", file.path, remote.Path)
+			}
+			if capabilities.StatByID && remote.ID == "" {
+				t.Errorf("Upload(%s) returned no ID", file.path)
+			}
+			uploaded[file.path] = remote
+		}
+
+		for _, file := range conformanceFiles {
+			remote, err := storage.Stat(FileRef{Path: file.path})
+			if err != nil {
+				t.Fatalf("Stat(%s) error = %v", file.path, err)
+			}
+			if remote.Path != file.path || remote.Name != filepath.Base(file.path) {
+				t.Errorf("Stat(%s) path, name = %q, %q", file.path, remote.Path, remote.Name)
+			}
+			if err := verifyRemoteFile(digestPayload([]byte(file.content)), remote); err != nil {
+				t.Errorf("Stat(%s) %v", file.path, err)
+			}
+
+			if capabilities.StatByID {
+				byID, err := storage.Stat(FileRef{ID: uploaded[file.path].ID})
+				if err != nil {
+					t.Fatalf("Stat(%s by ID) error = %v", file.path, err)
+				}
+				if byID.ID != uploaded[file.path].ID {
+					t.Errorf("Stat(%s by ID) ID = %q, want %q", file.path, byID.ID, uploaded[file.path].ID)
+				}
+			}
+
+			if exists, err := storage.Exists(FileRef{Path: file.path}); !exists || err != nil {
+				t.Errorf("Exists(%s) = %v, %v, want true, nil", file.path, exists, err)
+			}
+
+			reader, err := storage.Open(FileRef{ID: uploaded[file.path].ID, Path: file.path})
+			if err != nil {
+				t.Fatalf("Open(%s) error = %v", file.path, err)
+			}
+			content, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil || string(content) != file.content {
+				t.Errorf("Open(%s) = %q, %v, want %q", file.path, content, err, file.content)
+			}
+		}
+
+		if _, err := storage.Stat(FileRef{Path: "photos"}); !os.IsNotExist(err) {
+			t.Errorf("Stat(folder) error = %v, want os.ErrNotExist", err)
+		}
+
+		assertListed(t, storage, "a.txt", "e.gif", "it's d.txt", "photos/2024/c.jpg", "photos/b.png")
+
+		if capabilities.StatByID {
+			if err := storage.Delete(FileRef{ID: uploaded["a.txt"].ID, Path: "a.txt"}); err != nil {
+				t.Fatalf("Delete(a.txt by ID) error = %v", err)
+			}
+		} else if err := storage.Delete(FileRef{Path: "a.txt"}); err != nil {
+			t.Fatalf("Delete(a.txt) error = %v", err)
+		}
+		if err := storage.Delete(FileRef{Path: "photos/b.png"}); err != nil {
+			t.Fatalf("Delete(photos/b.png) error = %v", err)
+		}
+
+		for _, path := range []string{"a.txt", "photos/b.png"} {
+			if _, err := storage.Stat(FileRef{Path: path}); !os.IsNotExist(err) {
+				t.Errorf("Stat(%s) after delete error = %v, want os.ErrNotExist", path, err)
+			}
+			if exists, err := storage.Exists(FileRef{Path: path}); exists || err != nil {
+				t.Errorf("Exists(%s) after delete = %v, %v, want false, nil", path, exists, err)
+			}
+			if err := storage.Delete(FileRef{Path: path}); !os.IsNotExist(err) {
+				t.Errorf("Delete(%s) twice error = %v, want os.ErrNotExist", path, err)
+			}
+		}
+		if capabilities.StatByID {
+			if _, err := storage.Stat(FileRef{ID: uploaded["a.txt"].ID}); !os.IsNotExist(err) {
+				t.Errorf("Stat(a.txt by ID) after delete error = %v, want os.ErrNotExist", err)
+			}
+		}
+
+		assertListed(t, storage, "e.gif", "it's d.txt", "photos/2024/c.jpg")
+	})
+}
+
+// assertListed checks that listing storage returns exactly the files at paths, with their contents' sizes
+func assertListed(t *testing.T, storage StorageProvider, paths ...string) {
+	t.Helper()
+	files, err := listAll(storage)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+
+	listed := []string{}
+	for _, file := range files {
+		listed = append(listed, file.Path)
+		for _, want := range conformanceFiles {
+			if want.path == file.Path && file.Size != int64(len(want.content)) {
+				t.Errorf("List() size of %s = %d, want %d", file.Path, file.Size, len(want.content))
+			}
+		}
+	}
+	slices.Sort(listed)
+	if !slices.Equal(listed, paths) {
+		t.Errorf("List() = %q, want %q", listed, paths)
+	}
+}
+
+func TestLocalStorageConformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) StorageProvider {
+		return NewLocalStorage(filepath.Join(t.TempDir(), "discord-export"))
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// payloadDigest holds the size and every checksum a provider may report of the bytes written to it
+type payloadDigest struct {
+	size     int64
+	md5      hash.Hash
+	sha1     hash.Hash
+	sha256   hash.Hash
+	quickXor quickXorHasher
+}
+
+func newPayloadDigest() *payloadDigest {
+	return &payloadDigest{md5: md5.New(), sha1: sha1.New(), sha256: sha256.New()}
+}
+
+// digestPayload returns the digest of a payload held in memory
+func digestPayload(payload []byte) *payloadDigest {
+	digest := newPayloadDigest()
+	digest.Write(payload)
+	return digest
+}
+
+// Write adds p to the digest. It never fails.
+func (d *payloadDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	d.md5.Write(p)
+	d.sha1.Write(p)
+	d.sha256.Write(p)
+	d.quickXor.Write(p)
+	return len(p), nil
+}
+
+// verifyRemoteFile compares what a provider reports it stored against the digest of the bytes that were uploaded
+func verifyRemoteFile(digest *payloadDigest, remote *RemoteFile) error {
+	if remote == nil {
+		return nil
+	}
+
+	if remote.Size > 0 && remote.Size != digest.size {
+		return fmt.Errorf("size mismatch: uploaded %d bytes, provider stored %d bytes", digest.size, remote.Size)
+	}
+	if remote.MD5 != "" {
+		if local := hex.EncodeToString(digest.md5.Sum(nil)); !strings.EqualFold(remote.MD5, local) {
+			return fmt.Errorf("md5 mismatch: uploaded %s, provider stored %s", local, remote.MD5)
+		}
+	}
+	if remote.SHA1 != "" {
+		if local := hex.EncodeToString(digest.sha1.Sum(nil)); !strings.EqualFold(remote.SHA1, local) {
+			return fmt.Errorf("sha1 mismatch: uploaded %s, provider stored %s", local, remote.SHA1)
+		}
+	}
+	if remote.SHA256 != "" {
+		if local := hex.EncodeToString(digest.sha256.Sum(nil)); !strings.EqualFold(remote.SHA256, local) {
+			return fmt.Errorf("sha256 mismatch: uploaded %s, provider stored %s", local, remote.SHA256)
+		}
+	}
+	if remote.QuickXorHash != "" {
+		if local := digest.quickXor.Sum(); remote.QuickXorHash != local {
+			return fmt.Errorf("quickXorHash mismatch: uploaded %s, provider stored %s", local, remote.QuickXorHash)
+		}
+	}
+
+	return nil
+}
+
+// deleteUnverified removes an upload that failed verification, so retries don't leave corrupt copies behind
+func deleteUnverified(storage StorageProvider, remote *RemoteFile) {
+	capabilities := storage.Capabilities()
+	if !capabilities.Delete || !capabilities.StatByID || remote.ID == "" {
+		log.Warnf("The unverified copy of %s can't be deleted from %s, remove it by hand", remote.Path, storage.GetName())
+		return
+	}
+	if err := storage.Delete(FileRef{ID: remote.ID, Path: remote.Path}); err != nil {
+		log.Errorf("Error deleting the unverified copy of %s from %s: %v", remote.Path, storage.GetName(), err)
+	}
+}
+
+// uploadVerified uploads payload and checks the provider's report of the stored file against it.
+// A mismatching upload is retried up to UPLOAD_VERIFY_RETRIES times (default 2).
+func uploadVerified(storage StorageProvider, payload []byte, filename string) (*RemoteFile, error) {
+	if err := checkUploadSize(storage, int64(len(payload)), filename); err != nil {
+		return nil, err
+	}
+	remote, _, err := uploadVerifiedFrom(storage, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}, filename)
+	return remote, err
+}
+
+// checkUploadSize fails when a file of size bytes is larger than storage accepts
+func checkUploadSize(storage StorageProvider, size int64, filename string) error {
+	if limit := storage.Capabilities().MaxUploadSize; limit > 0 && size > limit {
+		return fmt.Errorf("%s is %d bytes, larger than the %d bytes %s accepts", filename, size, limit, storage.GetName())
+	}
+	return nil
+}
+
+// uploadVerifiedFrom streams what open returns to storage, hashing it on the way, and checks the provider's
+// report of the stored file against that. open is called again for every retry of a mismatching upload.
+// The digest of the verified upload is returned alongside it.
+func uploadVerifiedFrom(storage StorageProvider, open func() (io.ReadCloser, error), filename string) (*RemoteFile, *payloadDigest, error) {
+	retries := 2
+	if os.Getenv("UPLOAD_VERIFY_RETRIES") != "" {
+		var err error
+		retries, err = strconv.Atoi(os.Getenv("UPLOAD_VERIFY_RETRIES"))
+		if err != nil {
+			log.Errorf("Invalid UPLOAD_VERIFY_RETRIES: %v", err)
+			retries = 2
+		}
+	}
+
+	var verifyErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		source, err := open()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		digest := newPayloadDigest()
+		start := time.Now()
+		remote, err := storage.Upload(io.TeeReader(source, digest), filename)
+		source.Close()
+		if err != nil {
+			uploadDuration.WithLabelValues(storage.GetName(), "failure").Observe(time.Since(start).Seconds())
+			return nil, nil, err
+		}
+		uploadDuration.WithLabelValues(storage.GetName(), "success").Observe(time.Since(start).Seconds())
+		uploadBytes.WithLabelValues(storage.GetName()).Add(float64(digest.size))
+
+		verifyErr = verifyRemoteFile(digest, remote)
+		if verifyErr == nil {
+			return remote, digest, nil
+		}
+
+		uploadVerificationFailures.WithLabelValues(storage.GetName()).Inc()
+		log.Warnf("Verification of %s on %s failed (attempt %d of %d): %v", filename, storage.GetName(), attempt+1, retries+1, verifyErr)
+		deleteUnverified(storage, remote)
+	}
+
+	return nil, nil, fmt.Errorf("upload of %s could not be verified: %v", filename, verifyErr)
+}